@@ -0,0 +1,305 @@
+// Package area assembles polygons from multipolygon relations decoded by osmpbf.
+//
+// Member ways must have Locations, either from files with "LocationsOnWays" optional
+// feature or resolved by osmpbf.Decoder.SetLocationStore. In sorted files relations
+// follow ways, so Collector is usually filled in two passes over the file.
+//
+// Rings are joined from member ways with roles "outer", "inner" or empty role by node IDs.
+// Rings are classified by geometry: rings nested in an even number of other rings are outer,
+// the rest are inner. Roles contradicting geometry are reported in Multipolygon.RoleMismatches.
+package area
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/qedus/osmpbf"
+)
+
+// Ring is a closed sequence of locations, the first location equals the last one.
+// Outer rings are counterclockwise and inner rings are clockwise.
+type Ring []osmpbf.Location
+
+// Polygon is an outer ring with optional holes.
+type Polygon struct {
+	Outer  Ring
+	Inners []Ring
+}
+
+// Multipolygon is an area assembled from a relation.
+type Multipolygon struct {
+	// ID and Tags of the relation.
+	ID   int64
+	Tags map[string]string
+
+	Polygons []Polygon
+
+	// RoleMismatches lists rings with member roles not matching their geometry.
+	RoleMismatches []*RingError
+}
+
+// ErrorKind describes a problem with a ring.
+type ErrorKind int
+
+const (
+	// MissingWay means member way is not available.
+	MissingWay ErrorKind = iota + 1
+	// MissingLocation means member way has no location for some of its nodes.
+	MissingLocation
+	// OpenRing means ways do not form a closed ring.
+	OpenRing
+	// InvalidRing means ring has less than 3 distinct nodes.
+	InvalidRing
+	// RoleMismatch means role of member ways contradicts ring geometry.
+	RoleMismatch
+)
+
+var errorKindNames = map[ErrorKind]string{
+	MissingWay:      "missing way",
+	MissingLocation: "missing location",
+	OpenRing:        "open ring",
+	InvalidRing:     "invalid ring",
+	RoleMismatch:    "role mismatch",
+}
+
+func (k ErrorKind) String() string {
+	if s, ok := errorKindNames[k]; ok {
+		return s
+	}
+	return fmt.Sprintf("ErrorKind(%d)", int(k))
+}
+
+// RingError describes a ring which can not be assembled.
+type RingError struct {
+	RelationID int64
+	Kind       ErrorKind
+
+	// WayIDs of the ring, or the way which is missing or has missing locations.
+	WayIDs []int64
+
+	// NodeID is the node where an open ring ends, or the node with missing location.
+	NodeID int64
+}
+
+func (e *RingError) Error() string {
+	s := fmt.Sprintf("area: relation %d: %s", e.RelationID, e.Kind)
+	if e.NodeID != 0 {
+		s += fmt.Sprintf(" at node %d", e.NodeID)
+	}
+	return s + fmt.Sprintf(" (ways %v)", e.WayIDs)
+}
+
+// IsMultipolygon reports whether relation has "type" tag "multipolygon" or "boundary".
+func IsMultipolygon(r *osmpbf.Relation) bool {
+	t := r.Tags["type"]
+	return t == "multipolygon" || t == "boundary"
+}
+
+// Check whether member way is part of rings.
+func isRingMember(m osmpbf.Member) bool {
+	return m.Type == osmpbf.WayType && (m.Role == "outer" || m.Role == "inner" || m.Role == "")
+}
+
+// Assemble builds multipolygon from relation r and its member ways. It returns *RingError
+// for the first ring which can not be assembled.
+func Assemble(r *osmpbf.Relation, ways map[int64]*osmpbf.Way) (*Multipolygon, error) {
+	var members []member
+	seen := make(map[int64]bool)
+	for _, m := range r.Members {
+		if !isRingMember(m) || seen[m.ID] {
+			continue
+		}
+		seen[m.ID] = true
+
+		w := ways[m.ID]
+		if w == nil {
+			return nil, &RingError{RelationID: r.ID, Kind: MissingWay, WayIDs: []int64{m.ID}}
+		}
+		if len(w.Locations) != len(w.NodeIDs) {
+			return nil, &RingError{RelationID: r.ID, Kind: MissingLocation, WayIDs: []int64{w.ID}}
+		}
+		for index, loc := range w.Locations {
+			if math.IsNaN(loc.Lat) || math.IsNaN(loc.Lon) {
+				return nil, &RingError{RelationID: r.ID, Kind: MissingLocation, WayIDs: []int64{w.ID}, NodeID: w.NodeIDs[index]}
+			}
+		}
+		if len(w.NodeIDs) < 2 {
+			return nil, &RingError{RelationID: r.ID, Kind: InvalidRing, WayIDs: []int64{w.ID}}
+		}
+		members = append(members, member{w, m.Role})
+	}
+
+	rings, err := joinRings(members)
+	if err != nil {
+		err.RelationID = r.ID
+		return nil, err
+	}
+
+	mp := &Multipolygon{ID: r.ID, Tags: r.Tags}
+	mp.classify(rings)
+	return mp, nil
+}
+
+type member struct {
+	way  *osmpbf.Way
+	role string
+}
+
+// Ring with its nodes and roles of its member ways.
+type ring struct {
+	nodeIDs []int64
+	locs    Ring
+	wayIDs  []int64
+	roles   map[string]bool
+
+	depth  int
+	parent int
+}
+
+// Join ways into closed rings by node IDs.
+func joinRings(members []member) ([]*ring, *RingError) {
+	// members with a given end node
+	ends := make(map[int64][]int)
+	for index, m := range members {
+		ids := m.way.NodeIDs
+		ends[ids[0]] = append(ends[ids[0]], index)
+		ends[ids[len(ids)-1]] = append(ends[ids[len(ids)-1]], index)
+	}
+	used := make([]bool, len(members))
+
+	var rings []*ring
+	for index, m := range members {
+		if used[index] {
+			continue
+		}
+		used[index] = true
+		r := &ring{roles: make(map[string]bool)}
+		r.add(m, false)
+
+		for r.nodeIDs[0] != r.nodeIDs[len(r.nodeIDs)-1] {
+			last := r.nodeIDs[len(r.nodeIDs)-1]
+			next := -1
+			for _, i := range ends[last] {
+				if !used[i] {
+					next = i
+					break
+				}
+			}
+			if next < 0 {
+				return nil, &RingError{Kind: OpenRing, WayIDs: r.wayIDs, NodeID: last}
+			}
+			used[next] = true
+			ids := members[next].way.NodeIDs
+			r.add(members[next], ids[0] != last)
+		}
+
+		if len(r.nodeIDs) < 4 {
+			return nil, &RingError{Kind: InvalidRing, WayIDs: r.wayIDs}
+		}
+		rings = append(rings, r)
+	}
+	return rings, nil
+}
+
+// Append way nodes to ring, skipping the node shared with the previous way.
+func (r *ring) add(m member, reverse bool) {
+	ids, locs := m.way.NodeIDs, m.way.Locations
+	n := len(ids)
+	start := 0
+	if len(r.nodeIDs) > 0 {
+		start = 1
+	}
+	for i := start; i < n; i++ {
+		j := i
+		if reverse {
+			j = n - 1 - i
+		}
+		r.nodeIDs = append(r.nodeIDs, ids[j])
+		r.locs = append(r.locs, locs[j])
+	}
+	r.wayIDs = append(r.wayIDs, m.way.ID)
+	r.roles[m.role] = true
+}
+
+// Classify rings by nesting depth and build polygons.
+func (mp *Multipolygon) classify(rings []*ring) {
+	for i, r := range rings {
+		r.parent = -1
+		for j, other := range rings {
+			if i == j || !other.contains(r) {
+				continue
+			}
+			r.depth++
+			if r.parent < 0 || rings[r.parent].contains(other) {
+				r.parent = j
+			}
+		}
+	}
+
+	outers := make(map[int]int) // ring index to polygon index
+	for i, r := range rings {
+		if r.depth%2 == 0 {
+			mp.checkRole(r, "outer")
+			outers[i] = len(mp.Polygons)
+			mp.Polygons = append(mp.Polygons, Polygon{Outer: r.locs.oriented(true)})
+		}
+	}
+	for _, r := range rings {
+		if r.depth%2 == 1 {
+			mp.checkRole(r, "inner")
+			p := &mp.Polygons[outers[r.parent]]
+			p.Inners = append(p.Inners, r.locs.oriented(false))
+		}
+	}
+}
+
+func (mp *Multipolygon) checkRole(r *ring, role string) {
+	for rr := range r.roles {
+		if rr != "" && rr != role {
+			mp.RoleMismatches = append(mp.RoleMismatches, &RingError{RelationID: mp.ID, Kind: RoleMismatch, WayIDs: r.wayIDs})
+			return
+		}
+	}
+}
+
+// Check whether ring other is inside ring r. Rings may touch, so the first
+// node of other not shared with r is tested.
+func (r *ring) contains(other *ring) bool {
+	shared := make(map[int64]bool, len(r.nodeIDs))
+	for _, id := range r.nodeIDs {
+		shared[id] = true
+	}
+	for index, id := range other.nodeIDs {
+		if !shared[id] {
+			return r.locs.Contains(other.locs[index])
+		}
+	}
+	return false
+}
+
+// Contains reports whether location is inside the ring using even-odd rule,
+// as osmpbf.Polygon with the single ring does.
+func (r Ring) Contains(loc osmpbf.Location) bool {
+	return osmpbf.Polygon{r}.Contains(loc)
+}
+
+// Area returns signed area of the ring in square degrees, positive for counterclockwise rings.
+func (r Ring) Area() float64 {
+	var a float64
+	for i := 0; i+1 < len(r); i++ {
+		a += r[i].Lon*r[i+1].Lat - r[i+1].Lon*r[i].Lat
+	}
+	return a / 2
+}
+
+// Return ring with requested orientation.
+func (r Ring) oriented(counterclockwise bool) Ring {
+	if (r.Area() > 0) == counterclockwise {
+		return r
+	}
+	reversed := make(Ring, len(r))
+	for i, loc := range r {
+		reversed[len(r)-1-i] = loc
+	}
+	return reversed
+}
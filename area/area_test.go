@@ -0,0 +1,147 @@
+package area
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/qedus/osmpbf"
+)
+
+// node locations on a grid: node ID is 10*lon + lat
+func way(id int64, nodeIDs ...int64) *osmpbf.Way {
+	w := &osmpbf.Way{ID: id, NodeIDs: nodeIDs}
+	for _, n := range nodeIDs {
+		w.Locations = append(w.Locations, osmpbf.Location{Lat: float64(n % 10), Lon: float64(n / 10)})
+	}
+	return w
+}
+
+func waysMap(ways ...*osmpbf.Way) map[int64]*osmpbf.Way {
+	m := make(map[int64]*osmpbf.Way)
+	for _, w := range ways {
+		m[w.ID] = w
+	}
+	return m
+}
+
+func relation(members ...osmpbf.Member) *osmpbf.Relation {
+	return &osmpbf.Relation{ID: 1, Tags: map[string]string{"type": "multipolygon"}, Members: members}
+}
+
+var testWays = waysMap(
+	// outer square (0,0)-(8,8) split in two ways, the second one reversed
+	way(1, 0, 80, 88),
+	way(2, 0, 8, 88),
+	// hole (2,2)-(4,4)
+	way(3, 22, 42, 44, 24, 22),
+	// separate square (9,0)-(9,2)-(11,2)-(11,0) shares no nodes with the first
+	way(4, 90, 110, 112, 92, 90),
+	// second hole (5,5)-(7,7) with wrong role
+	way(5, 55, 75, 77, 57, 55),
+)
+
+func TestAssemble(t *testing.T) {
+	r := relation(
+		osmpbf.Member{ID: 1, Type: osmpbf.WayType, Role: "outer"},
+		osmpbf.Member{ID: 2, Type: osmpbf.WayType, Role: "outer"},
+		osmpbf.Member{ID: 3, Type: osmpbf.WayType, Role: "inner"},
+		osmpbf.Member{ID: 4, Type: osmpbf.WayType, Role: ""},
+		osmpbf.Member{ID: 5, Type: osmpbf.WayType, Role: "outer"}, // actually a hole
+		osmpbf.Member{ID: 6, Type: osmpbf.WayType, Role: "subarea"},
+		osmpbf.Member{ID: 7, Type: osmpbf.NodeType, Role: "label"},
+	)
+
+	mp, err := Assemble(r, testWays)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mp.Polygons) != 2 {
+		t.Fatalf("expected 2 polygons, got %d", len(mp.Polygons))
+	}
+	p := mp.Polygons[0]
+	if len(p.Outer) != 5 || p.Outer.Area() != 64 {
+		t.Errorf("unexpected outer ring %v with area %v", p.Outer, p.Outer.Area())
+	}
+	if len(p.Inners) != 2 || p.Inners[0].Area() != -4 || p.Inners[1].Area() != -4 {
+		t.Errorf("unexpected inner rings %v", p.Inners)
+	}
+	if len(mp.Polygons[1].Inners) != 0 || mp.Polygons[1].Outer.Area() != 4 {
+		t.Errorf("unexpected second polygon %v", mp.Polygons[1])
+	}
+	if len(mp.RoleMismatches) != 1 || mp.RoleMismatches[0].Kind != RoleMismatch ||
+		!reflect.DeepEqual(mp.RoleMismatches[0].WayIDs, []int64{5}) {
+		t.Errorf("unexpected role mismatches %v", mp.RoleMismatches)
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	for _, test := range []struct {
+		ways     map[int64]*osmpbf.Way
+		expected RingError
+	}{
+		{
+			waysMap(way(1, 0, 80, 88), way(2, 88, 8)),
+			RingError{RelationID: 1, Kind: OpenRing, WayIDs: []int64{1, 2}, NodeID: 8},
+		},
+		{
+			waysMap(way(1, 0, 80, 88), way(2, 0, 8, 99)),
+			RingError{RelationID: 1, Kind: OpenRing, WayIDs: []int64{1}, NodeID: 88},
+		},
+		{
+			waysMap(way(2, 0, 8, 88)),
+			RingError{RelationID: 1, Kind: MissingWay, WayIDs: []int64{1}},
+		},
+		{
+			waysMap(&osmpbf.Way{ID: 1, NodeIDs: []int64{0, 80, 88}}, way(2, 0, 8, 88)),
+			RingError{RelationID: 1, Kind: MissingLocation, WayIDs: []int64{1}},
+		},
+		{
+			waysMap(way(1, 0, 80), way(2, 80, 0)),
+			RingError{RelationID: 1, Kind: InvalidRing, WayIDs: []int64{1, 2}},
+		},
+	} {
+		r := relation(
+			osmpbf.Member{ID: 1, Type: osmpbf.WayType, Role: "outer"},
+			osmpbf.Member{ID: 2, Type: osmpbf.WayType, Role: "outer"},
+		)
+		_, err := Assemble(r, test.ways)
+
+		var re *RingError
+		if !errors.As(err, &re) {
+			t.Errorf("expected RingError, got %v", err)
+			continue
+		}
+		if !reflect.DeepEqual(*re, test.expected) {
+			t.Errorf("expected %v, got %v", &test.expected, re)
+		}
+	}
+}
+
+func TestCollector(t *testing.T) {
+	c := NewCollector()
+	if c.AddRelation(&osmpbf.Relation{ID: 2, Tags: map[string]string{"type": "route"}}) {
+		t.Error("route relation should not be kept")
+	}
+	c.AddRelation(relation(
+		osmpbf.Member{ID: 4, Type: osmpbf.WayType, Role: "outer"},
+		osmpbf.Member{ID: 3, Type: osmpbf.NodeType, Role: "label"},
+	))
+	c.AddRelation(&osmpbf.Relation{ID: 3, Tags: map[string]string{"type": "boundary"}, Members: []osmpbf.Member{
+		{ID: 1, Type: osmpbf.WayType, Role: "outer"},
+	}})
+
+	for _, w := range testWays {
+		if c.AddWay(w) != (w.ID == 4 || w.ID == 1) {
+			t.Errorf("unexpected AddWay result for way %d", w.ID)
+		}
+	}
+
+	mps, errs := c.Assemble()
+	if len(mps) != 1 || mps[0].ID != 1 {
+		t.Errorf("unexpected multipolygons %v", mps)
+	}
+	if len(errs) != 1 || errs[0].(*RingError).RelationID != 3 {
+		t.Errorf("unexpected errors %v", errs)
+	}
+}
@@ -0,0 +1,63 @@
+package area
+
+import "github.com/qedus/osmpbf"
+
+// Collector keeps multipolygon relations and their member ways until all of them are
+// available for Assemble. Usually relations are added in the first pass over a file,
+// and ways in the second one.
+type Collector struct {
+	relations []*osmpbf.Relation
+
+	// member ways, nil until added
+	ways map[int64]*osmpbf.Way
+}
+
+// NewCollector returns an empty Collector.
+func NewCollector() *Collector {
+	return &Collector{ways: make(map[int64]*osmpbf.Way)}
+}
+
+// AddRelation keeps relation if it is a multipolygon and reports whether it was kept.
+func (c *Collector) AddRelation(r *osmpbf.Relation) bool {
+	if !IsMultipolygon(r) {
+		return false
+	}
+	c.relations = append(c.relations, r)
+	for _, m := range r.Members {
+		if isRingMember(m) {
+			if _, ok := c.ways[m.ID]; !ok {
+				c.ways[m.ID] = nil
+			}
+		}
+	}
+	return true
+}
+
+// NeedsWay reports whether way with given ID is a member of kept relations.
+func (c *Collector) NeedsWay(id int64) bool {
+	_, ok := c.ways[id]
+	return ok
+}
+
+// AddWay keeps way if it is a member of kept relations and reports whether it was kept.
+func (c *Collector) AddWay(w *osmpbf.Way) bool {
+	if !c.NeedsWay(w.ID) {
+		return false
+	}
+	c.ways[w.ID] = w
+	return true
+}
+
+// Assemble assembles all kept relations in the order they were added. Relations which
+// can not be assembled are reported in errs and left out of multipolygons.
+func (c *Collector) Assemble() (multipolygons []*Multipolygon, errs []error) {
+	for _, r := range c.relations {
+		mp, err := Assemble(r, c.ways)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		multipolygons = append(multipolygons, mp)
+	}
+	return multipolygons, errs
+}
@@ -0,0 +1,232 @@
+package osmpbf
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// ChangeAction is an action of osmChange file.
+type ChangeAction int
+
+const (
+	Create ChangeAction = iota + 1
+	Modify
+	Delete
+)
+
+var changeActions = map[string]ChangeAction{
+	"create": Create,
+	"modify": Modify,
+	"delete": Delete,
+}
+
+func (a ChangeAction) String() string {
+	switch a {
+	case Create:
+		return "create"
+	case Modify:
+		return "modify"
+	case Delete:
+		return "delete"
+	}
+	return fmt.Sprintf("ChangeAction(%d)", int(a))
+}
+
+// Change is an object of osmChange file with its action.
+type Change struct {
+	Action ChangeAction
+
+	// Object is a pointer to Node, Way or Relation struct.
+	// Info.Visible of deleted objects is false.
+	Object interface{}
+}
+
+// A ChangeDecoder reads osmChange data (.osc files) from an input stream.
+type ChangeDecoder struct {
+	x *XMLDecoder
+
+	// action of the current block, 0 outside of blocks
+	action ChangeAction
+}
+
+// NewChangeDecoder returns a new decoder that reads from r.
+func NewChangeDecoder(r io.Reader) *ChangeDecoder {
+	return &ChangeDecoder{x: NewXMLDecoder(r)}
+}
+
+// Decode reads the next change. It returns io.EOF at the end of the stream.
+func (dec *ChangeDecoder) Decode() (*Change, error) {
+	if dec.x.err != nil {
+		return nil, dec.x.err
+	}
+
+	for {
+		t, err := dec.x.d.Token()
+		if err != nil {
+			if err != io.EOF {
+				dec.x.err = err
+			}
+			return nil, err
+		}
+
+		switch t := t.(type) {
+		case xml.StartElement:
+			if t.Name.Local == "osmChange" {
+				for _, a := range t.Attr {
+					if a.Name.Local == "version" && a.Value != "0.6" {
+						dec.x.err = fmt.Errorf("unsupported osmChange version %q", a.Value)
+						return nil, dec.x.err
+					}
+				}
+				continue
+			}
+			if action, ok := changeActions[t.Name.Local]; ok {
+				dec.action = action
+				continue
+			}
+
+			o, err := dec.x.decodeElement(&t)
+			if err != nil {
+				dec.x.err = err
+				return nil, err
+			}
+			if o == nil {
+				continue
+			}
+			if _, ok := o.(*Changeset); ok || dec.action == 0 {
+				dec.x.err = fmt.Errorf("unexpected element <%s> in osmChange", t.Name.Local)
+				return nil, dec.x.err
+			}
+			if dec.action == Delete {
+				setVisible(o, false)
+			}
+			return &Change{dec.action, o}, nil
+
+		case xml.EndElement:
+			if _, ok := changeActions[t.Name.Local]; ok {
+				dec.action = 0
+			}
+		}
+	}
+}
+
+func setVisible(o interface{}, visible bool) {
+	switch o := o.(type) {
+	case *Node:
+		o.Info.Visible = visible
+	case *Way:
+		o.Info.Visible = visible
+	case *Relation:
+		o.Info.Visible = visible
+	}
+}
+
+// ApplyChanges writes to w objects of PBF file r with changes applied. Objects of r must be
+// sorted by type, then by ID, and output is sorted the same way. If changes contain the same
+// object several times, the last change wins. Header of r is written with replication
+// sequence number and timestamp replaced by given values unless they are zero.
+func ApplyChanges(w io.Writer, r io.Reader, changes []*Change, sequenceNumber int64, timestamp time.Time) error {
+	type keyedChange struct {
+		kind int
+		id   int64
+		*Change
+	}
+	keyed := make([]keyedChange, 0, len(changes))
+	for _, c := range changes {
+		kind, id, ok := objectKindID(c.Object)
+		if !ok || kind == changesetKind {
+			return fmt.Errorf("unsupported change object type %T", c.Object)
+		}
+		keyed = append(keyed, keyedChange{kind, id, c})
+	}
+	less := func(a, b keyedChange) bool {
+		if a.kind != b.kind {
+			return a.kind < b.kind
+		}
+		return idLess(a.id, b.id)
+	}
+	sort.SliceStable(keyed, func(i, j int) bool {
+		return less(keyed[i], keyed[j])
+	})
+	// keep the last change of each object
+	n := 0
+	for index, c := range keyed {
+		if index+1 < len(keyed) && !less(c, keyed[index+1]) {
+			continue
+		}
+		keyed[n] = c
+		n++
+	}
+	keyed = keyed[:n]
+
+	dec := NewDecoder(r)
+	dec.CheckSortOrder()
+	header, err := dec.Header()
+	if err != nil {
+		return err
+	}
+	for _, feature := range header.RequiredFeatures {
+		if feature == "HistoricalInformation" {
+			return errors.New("changes can not be applied to history file")
+		}
+	}
+	h := *header
+	if sequenceNumber != 0 {
+		h.OsmosisReplicationSequenceNumber = sequenceNumber
+	}
+	if !timestamp.IsZero() {
+		h.OsmosisReplicationTimestamp = timestamp
+	}
+	if err = dec.Start(runtime.GOMAXPROCS(-1)); err != nil {
+		return err
+	}
+	defer dec.Close()
+
+	enc := NewEncoder(w, &h)
+	encodeChange := func(c keyedChange) error {
+		if c.Action == Delete {
+			return nil
+		}
+		return enc.Encode(c.Object)
+	}
+	for {
+		o, err := dec.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		kind, id, _ := objectKindID(o)
+		current := keyedChange{kind: kind, id: id}
+		for len(keyed) > 0 && !less(current, keyed[0]) {
+			replaced := !less(keyed[0], current)
+			if err = encodeChange(keyed[0]); err != nil {
+				return err
+			}
+			keyed = keyed[1:]
+			if replaced {
+				o = nil
+				break
+			}
+		}
+		if o == nil {
+			continue
+		}
+		if err = enc.Encode(o); err != nil {
+			return err
+		}
+	}
+	for _, c := range keyed {
+		if err = encodeChange(c); err != nil {
+			return err
+		}
+	}
+	return enc.Close()
+}
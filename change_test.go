@@ -0,0 +1,126 @@
+package osmpbf
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testOsmChange = `<?xml version="1.0" encoding="UTF-8"?>
+<osmChange version="0.6" generator="osmpbf-test">
+ <modify>
+  <node id="2" lat="2.5" lon="2.5" version="2" timestamp="2014-03-24T21:55:02Z" changeset="10" uid="5" user="a"/>
+ </modify>
+ <create>
+  <node id="4" lat="4" lon="4" version="1" timestamp="2014-03-24T21:55:02Z" changeset="10" uid="5" user="a">
+   <tag k="amenity" v="pub"/>
+  </node>
+  <way id="3" version="1" timestamp="2014-03-24T21:55:02Z" changeset="10" uid="5" user="a">
+   <nd ref="2"/>
+   <nd ref="4"/>
+  </way>
+ </create>
+ <delete>
+  <way id="1" version="2" timestamp="2014-03-24T21:55:02Z" changeset="10" uid="5" user="a"/>
+  <node id="3" version="2" timestamp="2014-03-24T21:55:02Z" changeset="10" uid="5" user="a"/>
+ </delete>
+ <modify>
+  <node id="2" lat="2.75" lon="2.75" version="3" timestamp="2014-03-24T21:55:02Z" changeset="10" uid="5" user="a"/>
+ </modify>
+</osmChange>
+`
+
+func decodeChanges(t *testing.T, s string) []*Change {
+	d := NewChangeDecoder(strings.NewReader(s))
+	var changes []*Change
+	for {
+		c, err := d.Decode()
+		if err == io.EOF {
+			return changes
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		changes = append(changes, c)
+	}
+}
+
+func TestChangeDecoder(t *testing.T) {
+	changes := decodeChanges(t, testOsmChange)
+
+	var actions []ChangeAction
+	var ids []int64
+	for _, c := range changes {
+		_, id, _ := objectKindID(c.Object)
+		actions = append(actions, c.Action)
+		ids = append(ids, id)
+	}
+	if expected := []ChangeAction{Modify, Create, Create, Delete, Delete, Modify}; !reflect.DeepEqual(expected, actions) {
+		t.Errorf("expected actions %v, got %v", expected, actions)
+	}
+	if expected := []int64{2, 4, 3, 1, 3, 2}; !reflect.DeepEqual(expected, ids) {
+		t.Errorf("expected IDs %v, got %v", expected, ids)
+	}
+	if changes[3].Object.(*Way).Info.Visible || !changes[1].Object.(*Node).Info.Visible {
+		t.Error("only deleted objects should be invisible")
+	}
+
+	d := NewChangeDecoder(strings.NewReader(`<osmChange version="0.6"><node id="1"/></osmChange>`))
+	if _, err := d.Decode(); err == nil {
+		t.Error("expected error for object outside of action")
+	}
+}
+
+func TestApplyChanges(t *testing.T) {
+	info := Info{Version: 1, Timestamp: parseTime("2010-01-02T03:04:05Z"), Changeset: 1, Uid: 1, User: "b", Visible: true}
+	objects := []interface{}{
+		&Node{ID: 1, Lat: 1, Lon: 1, Tags: map[string]string{}, Info: info},
+		&Node{ID: 2, Lat: 2, Lon: 2, Tags: map[string]string{}, Info: info},
+		&Node{ID: 3, Lat: 3, Lon: 3, Tags: map[string]string{}, Info: info},
+		&Way{ID: 1, Tags: map[string]string{}, NodeIDs: []int64{1, 3}, Info: info},
+		&Way{ID: 2, Tags: map[string]string{}, NodeIDs: []int64{1, 2}, Info: info},
+		&Relation{ID: 1, Tags: map[string]string{}, Members: []Member{{2, WayType, ""}}, Info: info},
+	}
+	changes := decodeChanges(t, testOsmChange)
+
+	var buf bytes.Buffer
+	timestamp := time.Date(2014, 3, 25, 0, 0, 0, 0, time.UTC)
+	err := ApplyChanges(&buf, bytes.NewReader(encodePBF(t, encodeHeader, objects)), changes, 43, timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDecoder(&buf)
+	header, err := d.Header()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.OsmosisReplicationSequenceNumber != 43 || !header.OsmosisReplicationTimestamp.Equal(timestamp) {
+		t.Errorf("unexpected replication fields %d %v", header.OsmosisReplicationSequenceNumber, header.OsmosisReplicationTimestamp)
+	}
+	if header.OsmosisReplicationBaseUrl != encodeHeader.OsmosisReplicationBaseUrl {
+		t.Errorf("unexpected replication base URL %q", header.OsmosisReplicationBaseUrl)
+	}
+
+	expected := []interface{}{
+		objects[0],
+		changes[5].Object,
+		changes[1].Object,
+		objects[4],
+		changes[2].Object,
+		objects[5],
+	}
+	if actual := decodeAll(t, d); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("\nExpected: %#v\nActual:   %#v", expected, actual)
+	}
+
+	// unsorted input
+	objects[0], objects[1] = objects[1], objects[0]
+	err = ApplyChanges(io.Discard, bytes.NewReader(encodePBF(t, nil, objects)), nil, 0, time.Time{})
+	if err == nil {
+		t.Error("expected error for unsorted input")
+	}
+}
@@ -1,20 +1,25 @@
-// Package osmpbf decodes OpenStreetMap (OSM) PBF files.
+// Package osmpbf decodes and encodes OpenStreetMap (OSM) PBF files.
 // Use this package by creating a NewDecoder and passing it a PBF file.
 // Use Start to start decoding process.
 // Use Decode to return Node, Way and Relation structs.
+// Use NewEncoder and Encode to write them back to a PBF file.
 package osmpbf // import "github.com/qedus/osmpbf"
 
 import (
 	"bytes"
 	"compress/zlib"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/qedus/osmpbf/OSMPBF"
+	"github.com/ulikunitz/xz/lzma"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -28,10 +33,25 @@ const (
 )
 
 var (
+	// ErrDecoderClosed is returned by Decode after Decoder is closed.
+	ErrDecoderClosed = errors.New("decoder closed")
+
+	// ErrUnsorted is wrapped by errors for objects out of order in files with
+	// "Sort.Type_then_ID" optional feature, see CheckSortOrder.
+	ErrUnsorted = errors.New("objects not sorted by type then ID")
+
 	parseCapabilities = map[string]bool{
-		"OsmSchema-V0.6": true,
-		"DenseNodes":     true,
+		"OsmSchema-V0.6":        true,
+		"DenseNodes":            true,
+		"HistoricalInformation": true,
 	}
+
+	supportedCompressions = []string{"raw", "zlib", "lzma", "lz4", "zstd"}
+
+	// shared by all data decoders, created on first use
+	zstdDecoder     *zstd.Decoder
+	zstdDecoderErr  error
+	zstdDecoderOnce sync.Once
 )
 
 type BoundingBox struct {
@@ -50,6 +70,10 @@ type Header struct {
 	OsmosisReplicationTimestamp      time.Time
 	OsmosisReplicationSequenceNumber int64
 	OsmosisReplicationBaseUrl        string
+
+	// UnknownRequiredFeatures lists required features the Decoder does not support.
+	// It may be non-empty only if Decoder.AllowUnknownFeatures was called.
+	UnknownRequiredFeatures []string
 }
 
 type Info struct {
@@ -67,6 +91,9 @@ type Node struct {
 	Lon  float64
 	Tags map[string]string
 	Info Info
+
+	// TagList holds tags instead of Tags in Decoder.ReuseObjects mode.
+	TagList []Tag
 }
 
 type Way struct {
@@ -74,6 +101,18 @@ type Way struct {
 	Tags    map[string]string
 	NodeIDs []int64
 	Info    Info
+
+	// Locations of NodeIDs, only present in files with "LocationsOnWays" optional feature.
+	Locations []Location
+
+	// TagList holds tags instead of Tags in Decoder.ReuseObjects mode.
+	TagList []Tag
+}
+
+// Location is a node coordinate in degrees.
+type Location struct {
+	Lat float64
+	Lon float64
 }
 
 type Relation struct {
@@ -81,6 +120,9 @@ type Relation struct {
 	Tags    map[string]string
 	Members []Member
 	Info    Info
+
+	// TagList holds tags instead of Tags in Decoder.ReuseObjects mode.
+	TagList []Tag
 }
 
 type MemberType int
@@ -97,6 +139,83 @@ type Member struct {
 	Role string
 }
 
+// Changeset is a changeset entry of PrimitiveGroup. PBF files store only changeset ID.
+type Changeset struct {
+	ID int64
+}
+
+// kinds of objects in the order they appear in sorted files
+const (
+	nodeKind = iota
+	wayKind
+	relationKind
+	changesetKind
+)
+
+// Return kind and ID of pointer to Node, Way, Relation or Changeset struct.
+func objectKindID(o interface{}) (int, int64, bool) {
+	switch o := o.(type) {
+	case *Node:
+		return nodeKind, o.ID, true
+	case *Way:
+		return wayKind, o.ID, true
+	case *Relation:
+		return relationKind, o.ID, true
+	case *Changeset:
+		return changesetKind, o.ID, true
+	default:
+		return 0, 0, false
+	}
+}
+
+// Handler processes objects decoded by Decoder.Run.
+type Handler interface {
+	Node(*Node)
+	Way(*Way)
+	Relation(*Relation)
+	Changeset(*Changeset)
+}
+
+// Block is a decoded PrimitiveBlock returned by Decoder.DecodeBlock.
+type Block struct {
+	// Index is the position of the fileblock in the input stream;
+	// the OSMHeader fileblock has index 0.
+	Index int64
+
+	// Offset is the position of the fileblock in the input stream in bytes.
+	Offset int64
+
+	Nodes      []*Node
+	Ways       []*Way
+	Relations  []*Relation
+	Changesets []*Changeset
+}
+
+// Blob read from the input stream and its position
+type fileBlock struct {
+	index  int64
+	offset int64
+	blob   *OSMPBF.Blob
+
+	// size and error of fileblock skipped by SkipCorruptBlobs mode
+	size int64
+	err  *DecodeError
+}
+
+// Objects decoded from fileBlock
+type decodedBlock struct {
+	index   int64
+	offset  int64
+	objects []interface{}
+
+	// size and error of fileblock skipped by SkipCorruptBlobs mode
+	size int64
+	err  *DecodeError
+
+	// memory of objects in ReuseObjects mode
+	arena *blockArena
+}
+
 type pair struct {
 	i interface{}
 	e error
@@ -111,12 +230,56 @@ type Decoder struct {
 
 	// store header block
 	header *Header
+	// extra parse capabilities and permissive mode for required features
+	capabilities         map[string]bool
+	allowUnknownFeatures bool
 	// synchronize header deserialization
 	headerOnce sync.Once
 
+	// position of the next fileblock in the input stream
+	index  int64
+	offset int64
+
 	// for data decoders
 	inputs  []chan<- pair
 	outputs []<-chan pair
+
+	// which data to decode
+	options decodeOptions
+	// check Sort.Type_then_ID order
+	checkSortOrder bool
+	// node locations for ways
+	locations LocationStore
+
+	// SkipCorruptBlobs mode
+	skipCorrupt          bool
+	corruptHandler       func(err *DecodeError)
+	rr                   *resyncReader
+	lostBlobs, lostBytes atomic.Int64
+
+	// progress counters
+	stats decodeStats
+
+	// option set after Start, returned by decoding methods
+	usageErr error
+
+	// ReuseObjects mode: block borrowed by the caller of Decode or DecodeBlock,
+	// position of the next object and error to return after its objects
+	borrowMu     sync.Mutex
+	borrowed     *decodedBlock
+	borrowedNext int
+	borrowedErr  error
+
+	// decoded blobs in file order
+	blobs chan pair
+	// synchronize start of serializer used by Decode
+	serializerOnce sync.Once
+
+	// for stopping decoding process
+	ctx    context.Context
+	cancel context.CancelFunc
+	closed atomic.Bool
+	wg     sync.WaitGroup
 }
 
 // NewDecoder returns a new decoder that reads from r.
@@ -124,6 +287,7 @@ func NewDecoder(r io.Reader) *Decoder {
 	d := &Decoder{
 		r:          r,
 		serializer: make(chan pair, 8000), // typical PrimitiveBlock contains 8k OSM entities
+		blobs:      make(chan pair, 1),
 	}
 	d.SetBufferSize(initialBlobBufSize)
 	return d
@@ -136,6 +300,68 @@ func (dec *Decoder) SetBufferSize(n int) {
 	dec.buf = bytes.NewBuffer(make([]byte, 0, n))
 }
 
+// AddCapabilities declares required features the caller knows are safe to ignore,
+// in addition to features supported by the Decoder. It must be called before Header or Start.
+func (dec *Decoder) AddCapabilities(features ...string) {
+	if dec.capabilities == nil {
+		dec.capabilities = make(map[string]bool)
+	}
+	for _, feature := range features {
+		dec.capabilities[feature] = true
+	}
+}
+
+// AllowUnknownFeatures makes Decoder read files with unsupported required features
+// instead of returning an error. Such features are reported in Header.UnknownRequiredFeatures.
+// It must be called before Header or Start.
+func (dec *Decoder) AllowUnknownFeatures() {
+	dec.allowUnknownFeatures = true
+}
+
+// CheckSortOrder makes Decoder return an error wrapping ErrUnsorted as soon as objects are not
+// sorted by type (nodes, ways, relations, changesets), then by ID, as promised by "Sort.Type_then_ID"
+// optional feature. The order is checked whether or not the header has that feature. Objects with the same
+// type and ID are allowed only if the header has "HistoricalInformation" required feature.
+// It must be called before Start.
+func (dec *Decoder) CheckSortOrder() {
+	dec.checkSortOrder = true
+}
+
+// SkipNodes makes Decoder skip nodes without building them. Data skipped by Skip methods is
+// not unpacked from PrimitiveBlocks, except node locations needed by SetLocationStore.
+// It must be called before Start.
+func (dec *Decoder) SkipNodes() {
+	dec.options.skipNodes = true
+}
+
+// SkipWays makes Decoder skip ways without building them. It must be called before Start.
+func (dec *Decoder) SkipWays() {
+	dec.options.skipWays = true
+}
+
+// SkipRelations makes Decoder skip relations without building them. It must be called before Start.
+func (dec *Decoder) SkipRelations() {
+	dec.options.skipRelations = true
+}
+
+// SkipInfo makes Decoder skip metadata of objects. Info fields are left as for files
+// without metadata. It must be called before Start.
+func (dec *Decoder) SkipInfo() {
+	dec.options.skipInfo = true
+}
+
+// SkipTags makes Decoder skip tags of objects, leaving Tags nil. Tags are still unpacked
+// for the filter set by SetTagFilter. It must be called before Start.
+func (dec *Decoder) SkipTags() {
+	dec.options.skipTags = true
+}
+
+// SetTagFilter makes Decoder return only objects selected by f. Tags are checked
+// by decoding goroutines before objects are built. It must be called before Start.
+func (dec *Decoder) SetTagFilter(f *TagFilter) {
+	dec.options.tagFilter = f
+}
+
 // Header returns file header.
 func (dec *Decoder) Header() (*Header, error) {
 	// deserialize the file header
@@ -144,31 +370,70 @@ func (dec *Decoder) Header() (*Header, error) {
 
 // Start decoding process using n goroutines.
 func (dec *Decoder) Start(n int) error {
+	return dec.StartContext(context.Background(), n)
+}
+
+// StartContext starts decoding process using n goroutines. Decoding stops when ctx is done
+// or Close is called; after that Decode returns ctx.Err() or ErrDecoderClosed. Decoding
+// goroutines also exit by themselves after the end of input or the first error is returned,
+// so Close is only needed to stop decoding early.
+func (dec *Decoder) StartContext(ctx context.Context, n int) error {
 	if n < 1 {
 		n = 1
 	}
 
+	if dec.closed.Load() {
+		return ErrDecoderClosed
+	}
+	dec.ctx, dec.cancel = context.WithCancel(ctx)
+
 	if err := dec.readOSMHeader(); err != nil {
 		return err
 	}
 
+	// reading and decoding goroutines stop when decoding is stopped, or once the collector
+	// delivered the end of input or the first error, so Close is not needed to release them
+	pipeline, stopPipeline := context.WithCancel(dec.ctx)
+
 	// start data decoders
 	for i := 0; i < n; i++ {
 		input := make(chan pair)
 		output := make(chan pair)
+		dec.wg.Add(1)
 		go func() {
-			dd := new(dataDecoder)
+			defer dec.wg.Done()
+			defer close(output)
+
+			dd := &dataDecoder{options: dec.options}
 			for p := range input {
 				if p.e == nil {
 					// send decoded objects or decoding error
-					objects, err := dd.Decode(p.i.(*OSMPBF.Blob))
-					output <- pair{objects, err}
-				} else {
-					// send input error as is
-					output <- pair{nil, p.e}
+					fb := p.i.(*fileBlock)
+					db := &decodedBlock{index: fb.index, offset: fb.offset, size: fb.size, err: fb.err}
+					if db.err == nil {
+						var err error
+						db.objects, err = dd.Decode(fb.blob)
+						db.arena = dd.arena
+						err = positionError(err, fb.index, fb.offset)
+						if err != nil && dec.skipCorrupt {
+							db.objects = nil
+							db.err = asDecodeError(err, fb.index, fb.offset, "OSMData", StagePrimitiveBlock)
+						} else {
+							p.e = err
+						}
+						if err == nil {
+							dec.stats.addBlob(fb.blob)
+						}
+					}
+					p.i = db
+				}
+				// send input error as is
+				select {
+				case output <- p:
+				case <-pipeline.Done():
+					return
 				}
 			}
-			close(output)
 		}()
 
 		dec.inputs = append(dec.inputs, input)
@@ -176,133 +441,424 @@ func (dec *Decoder) Start(n int) error {
 	}
 
 	// start reading OSMData
+	dec.wg.Add(1)
 	go func() {
+		defer dec.wg.Done()
+		defer func() {
+			for _, input := range dec.inputs {
+				close(input)
+			}
+		}()
+
 		var inputIndex int
-		for {
+		for pipeline.Err() == nil {
 			input := dec.inputs[inputIndex]
 			inputIndex = (inputIndex + 1) % n
 
+			index, offset := dec.index, dec.offset
 			blobHeader, blob, err := dec.readFileBlock()
 			if err == nil && blobHeader.GetType() != "OSMData" {
-				err = fmt.Errorf("unexpected fileblock of type %s", blobHeader.GetType())
+				err = &DecodeError{index, offset, blobHeader.GetType(), StageBlobHeader,
+					fmt.Errorf("%w %s", ErrUnexpectedBlobType, blobHeader.GetType())}
 			}
-			if err == nil {
-				// send blob for decoding
-				input <- pair{blob, nil}
-			} else {
+			fb := &fileBlock{index: index, offset: offset, blob: blob, size: dec.offset - offset}
+			if err != nil && err != io.EOF && dec.skipCorrupt {
+				// send skipped fileblock for reporting in file order
+				fb.err = asDecodeError(err, index, offset, blobHeader.GetType(), StageBlob)
+				switch {
+				case blobHeader == nil:
+					err = dec.resync()
+				case blob == nil:
+					dec.skipBlob()
+					err = nil
+				default:
+					// fileblock of unexpected type is already skipped
+					err = nil
+				}
+				fb.size = dec.offset - offset
+			}
+			if err == nil || fb.err != nil {
+				// send blob for decoding, or skipped fileblock even if resync failed
+				select {
+				case input <- pair{fb, nil}:
+				case <-pipeline.Done():
+				}
+			}
+			if err != nil {
+				if fb.err != nil {
+					input = dec.inputs[inputIndex]
+				}
 				// send input error as is
-				input <- pair{nil, err}
-				for _, input := range dec.inputs {
-					close(input)
+				select {
+				case input <- pair{nil, err}:
+				case <-pipeline.Done():
 				}
 				return
 			}
 		}
 	}()
 
+	var sc *sortChecker
+	if dec.checkSortOrder {
+		sc = new(sortChecker)
+		for _, feature := range dec.header.RequiredFeatures {
+			if feature == "HistoricalInformation" {
+				sc.history = true
+			}
+		}
+	}
+
+	// collect decoded blobs in file order
+	dec.wg.Add(1)
 	go func() {
+		defer dec.wg.Done()
+		defer close(dec.blobs)
+		defer stopPipeline()
+
 		var outputIndex int
 		for {
 			output := dec.outputs[outputIndex]
 			outputIndex = (outputIndex + 1) % n
 
-			p := <-output
+			var p pair
+			var ok bool
+			select {
+			case p, ok = <-output:
+				if !ok {
+					// worker stopped on cancellation
+					return
+				}
+			case <-dec.ctx.Done():
+				return
+			}
+			if p.e == nil {
+				if db := p.i.(*decodedBlock); db.err != nil {
+					dec.reportCorrupt(db)
+					continue
+				}
+			}
+			if dec.locations != nil && p.e == nil {
+				db := p.i.(*decodedBlock)
+				db.objects, p.e = dec.resolveLocations(db.arena, db.objects)
+			}
+			if sc != nil && p.e == nil {
+				// send objects in order and error for the first one out of order
+				db := p.i.(*decodedBlock)
+				var n int
+				n, p.e = sc.check(db.index, db.objects)
+				db.objects = db.objects[:n]
+			}
+			if db, ok := p.i.(*decodedBlock); ok {
+				dec.stats.addObjects(db.objects)
+			}
+			select {
+			case dec.blobs <- p:
+			case <-dec.ctx.Done():
+				return
+			}
+			if p.e != nil {
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// startSerializer starts sending decoded objects one by one for Decode.
+func (dec *Decoder) startSerializer() {
+	dec.wg.Add(1)
+	go func() {
+		defer dec.wg.Done()
+		defer close(dec.serializer)
+
+		for p := range dec.blobs {
 			if p.i != nil {
 				// send decoded objects one by one
-				for _, o := range p.i.([]interface{}) {
-					dec.serializer <- pair{o, nil}
+				for _, o := range p.i.(*decodedBlock).objects {
+					select {
+					case dec.serializer <- pair{o, nil}:
+					case <-dec.ctx.Done():
+						return
+					}
 				}
 			}
 			if p.e != nil {
 				// send input or decoding error
-				dec.serializer <- pair{nil, p.e}
-				close(dec.serializer)
+				select {
+				case dec.serializer <- pair{nil, p.e}:
+				case <-dec.ctx.Done():
+				}
 				return
 			}
 		}
 	}()
-
-	return nil
 }
 
 // Decode reads the next object from the input stream and returns either a
-// pointer to Node, Way or Relation struct representing the underlying OpenStreetMap PBF
+// pointer to Node, Way, Relation or Changeset struct representing the underlying OpenStreetMap PBF
 // data, or error encountered. The end of the input stream is reported by an io.EOF error.
 //
 // Decode is safe for parallel execution. Only first error encountered will be returned,
 // subsequent invocations will return io.EOF.
 func (dec *Decoder) Decode() (interface{}, error) {
+	if err := dec.stopErr(); err != nil {
+		return nil, err
+	}
+	if dec.options.arenas != nil {
+		return dec.decodeBorrowed()
+	}
+	dec.serializerOnce.Do(dec.startSerializer)
+
 	p, ok := <-dec.serializer
 	if !ok {
+		if err := dec.stopErr(); err != nil {
+			return nil, err
+		}
 		return nil, io.EOF
 	}
 	return p.i, p.e
 }
 
+// Run calls h for every decoded object in the order of the input stream until the end of
+// the input stream or first error encountered. It returns nil at the end of the input stream.
+// Run must be called after Start and must not be mixed with Decode.
+func (dec *Decoder) Run(h Handler) error {
+	for {
+		if err := dec.stopErr(); err != nil {
+			return err
+		}
+
+		p, ok := <-dec.blobs
+		if !ok {
+			return dec.stopErr()
+		}
+		if p.i != nil {
+			for _, o := range p.i.(*decodedBlock).objects {
+				switch o := o.(type) {
+				case *Node:
+					h.Node(o)
+				case *Way:
+					h.Way(o)
+				case *Relation:
+					h.Relation(o)
+				case *Changeset:
+					h.Changeset(o)
+				}
+			}
+			dec.releaseBlock(p.i.(*decodedBlock))
+		}
+		if p.e == io.EOF {
+			return nil
+		}
+		if p.e != nil {
+			return p.e
+		}
+	}
+}
+
+// DecodeBlock reads the next PrimitiveBlock from the input stream and returns objects
+// it contains, or error encountered. The end of the input stream is reported by an io.EOF error.
+// If an error such as ErrUnsorted is found within a block, the block is returned with objects
+// before the error together with the error.
+// DecodeBlock must be called after Start and must not be mixed with Decode or Run.
+//
+// DecodeBlock is safe for parallel execution, but blocks are returned in file order
+// only if it is called sequentially.
+func (dec *Decoder) DecodeBlock() (*Block, error) {
+	if err := dec.stopErr(); err != nil {
+		return nil, err
+	}
+	if dec.options.arenas != nil {
+		dec.borrowMu.Lock()
+		defer dec.borrowMu.Unlock()
+		if dec.borrowed != nil {
+			dec.releaseBlock(dec.borrowed)
+			dec.borrowed = nil
+		}
+	}
+
+	p, ok := <-dec.blobs
+	if !ok {
+		if err := dec.stopErr(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	if p.i == nil {
+		return nil, p.e
+	}
+
+	// objects of the block before an error found in it are returned with the error
+	db := p.i.(*decodedBlock)
+	if db.arena != nil {
+		dec.borrowed = db
+		b := &db.arena.block
+		*b = Block{
+			Index:      db.index,
+			Offset:     db.offset,
+			Nodes:      b.Nodes[:0],
+			Ways:       b.Ways[:0],
+			Relations:  b.Relations[:0],
+			Changesets: b.Changesets[:0],
+		}
+		b.add(db.objects)
+		return b, p.e
+	}
+	return newBlock(db.index, db.offset, db.objects), p.e
+}
+
+func newBlock(index, offset int64, objects []interface{}) *Block {
+	b := &Block{Index: index, Offset: offset}
+	b.add(objects)
+	return b
+}
+
+// Sort objects by type.
+func (b *Block) add(objects []interface{}) {
+	for _, o := range objects {
+		switch o := o.(type) {
+		case *Node:
+			b.Nodes = append(b.Nodes, o)
+		case *Way:
+			b.Ways = append(b.Ways, o)
+		case *Relation:
+			b.Relations = append(b.Relations, o)
+		case *Changeset:
+			b.Changesets = append(b.Changesets, o)
+		}
+	}
+}
+
+// Close stops decoding process and waits for decoding goroutines to exit.
+// Subsequent calls to Decode return ErrDecoderClosed. Close does not interrupt
+// a blocked read from the input stream; close the underlying reader for that.
+func (dec *Decoder) Close() error {
+	dec.closed.Store(true)
+	if dec.cancel != nil {
+		dec.cancel()
+	}
+	dec.wg.Wait()
+	return nil
+}
+
+// stopErr returns error describing why decoding process was stopped early, if it was.
+func (dec *Decoder) stopErr() error {
+	if dec.closed.Load() {
+		return ErrDecoderClosed
+	}
+	if dec.usageErr != nil {
+		return dec.usageErr
+	}
+	if dec.ctx != nil {
+		return dec.ctx.Err()
+	}
+	return nil
+}
+
+// Read the next fileblock. Returns io.EOF at the end of input and *DecodeError otherwise.
 func (dec *Decoder) readFileBlock() (*OSMPBF.BlobHeader, *OSMPBF.Blob, error) {
+	// keep all bytes of fileblock in buffer for SkipCorruptBlobs mode
+	dec.buf.Reset()
 	blobHeaderSize, err := dec.readBlobHeaderSize()
-	if err != nil {
+	if err == io.EOF {
 		return nil, nil, err
 	}
+	if err != nil {
+		return nil, nil, dec.decodeError(StageBlobHeaderSize, "", err)
+	}
 
 	blobHeader, err := dec.readBlobHeader(blobHeaderSize)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, dec.decodeError(StageBlobHeader, "", err)
 	}
 
 	blob, err := dec.readBlob(blobHeader)
 	if err != nil {
-		return nil, nil, err
+		// valid BlobHeader lets SkipCorruptBlobs mode skip the Blob as a whole
+		return blobHeader, nil, dec.decodeError(StageBlob, blobHeader.GetType(), err)
 	}
 
+	dec.index++
+	dec.offset += 4 + int64(blobHeaderSize) + int64(blobHeader.GetDatasize())
+	dec.stats.blobsRead.Add(1)
+	dec.stats.bytesRead.Store(dec.offset)
 	return blobHeader, blob, err
 }
 
+// Error for fileblock at current position.
+func (dec *Decoder) decodeError(stage DecodeStage, blobType string, err error) error {
+	return &DecodeError{dec.index, dec.offset, blobType, stage, err}
+}
+
+// Append n bytes to buffer; input ending inside of fileblock is reported as io.ErrUnexpectedEOF.
+func (dec *Decoder) readFull(n int64) error {
+	_, err := io.CopyN(dec.buf, dec.r, n)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
 func (dec *Decoder) readBlobHeaderSize() (uint32, error) {
-	dec.buf.Reset()
-	if _, err := io.CopyN(dec.buf, dec.r, 4); err != nil {
+	if n, err := io.CopyN(dec.buf, dec.r, 4); err != nil {
+		if err == io.EOF && n > 0 {
+			err = io.ErrUnexpectedEOF
+		}
 		return 0, err
 	}
 
 	size := binary.BigEndian.Uint32(dec.buf.Bytes())
 
 	if size >= maxBlobHeaderSize {
-		return 0, errors.New("BlobHeader size >= 64Kb")
+		return 0, ErrBlobHeaderTooLarge
 	}
 	return size, nil
 }
 
 func (dec *Decoder) readBlobHeader(size uint32) (*OSMPBF.BlobHeader, error) {
-	dec.buf.Reset()
-	if _, err := io.CopyN(dec.buf, dec.r, int64(size)); err != nil {
+	start := dec.buf.Len()
+	if err := dec.readFull(int64(size)); err != nil {
 		return nil, err
 	}
 
 	blobHeader := new(OSMPBF.BlobHeader)
-	if err := proto.Unmarshal(dec.buf.Bytes(), blobHeader); err != nil {
+	if err := proto.Unmarshal(dec.buf.Bytes()[start:], blobHeader); err != nil {
 		return nil, err
 	}
 
 	if blobHeader.GetDatasize() >= MaxBlobSize {
-		return nil, errors.New("Blob size >= 32Mb")
+		return nil, ErrBlobTooLarge
 	}
 	return blobHeader, nil
 }
 
 func (dec *Decoder) readBlob(blobHeader *OSMPBF.BlobHeader) (*OSMPBF.Blob, error) {
-	dec.buf.Reset()
-	if _, err := io.CopyN(dec.buf, dec.r, int64(blobHeader.GetDatasize())); err != nil {
+	start := dec.buf.Len()
+	if err := dec.readFull(int64(blobHeader.GetDatasize())); err != nil {
 		return nil, err
 	}
 
 	blob := new(OSMPBF.Blob)
-	if err := proto.Unmarshal(dec.buf.Bytes(), blob); err != nil {
+	if err := proto.Unmarshal(dec.buf.Bytes()[start:], blob); err != nil {
 		return nil, err
 	}
 	return blob, nil
 }
 
+// SupportedCompressions returns names of Blob compressions the Decoder can read.
+// Names match Blob data fields in fileformat.proto without the "_data" suffix.
+func SupportedCompressions() []string {
+	return append([]string(nil), supportedCompressions...)
+}
+
 func getData(blob *OSMPBF.Blob) ([]byte, error) {
+	if _, ok := blob.Data.(*OSMPBF.Blob_Raw); !ok {
+		if err := checkRawSizeRange(blob); err != nil {
+			return nil, err
+		}
+	}
+
 	switch blob.Data.(type) {
 	case *OSMPBF.Blob_Raw:
 		return blob.GetRaw(), nil
@@ -313,19 +869,89 @@ func getData(blob *OSMPBF.Blob) ([]byte, error) {
 			return nil, err
 		}
 		buf := bytes.NewBuffer(make([]byte, 0, blob.GetRawSize()+bytes.MinRead))
-		_, err = buf.ReadFrom(r)
+		_, err = buf.ReadFrom(limitRawSize(blob, r))
 		if err != nil {
 			return nil, err
 		}
-		if buf.Len() != int(blob.GetRawSize()) {
-			err = fmt.Errorf("raw blob data size %d but expected %d", buf.Len(), blob.GetRawSize())
+		return checkRawSize(blob, buf.Bytes())
+
+	case *OSMPBF.Blob_ZstdData:
+		zstdDecoderOnce.Do(func() {
+			// nil reader is fine since only DecodeAll is used; it is safe for concurrent use
+			zstdDecoder, zstdDecoderErr = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0),
+				zstd.WithDecoderMaxMemory(MaxBlobSize))
+		})
+		if zstdDecoderErr != nil {
+			return nil, zstdDecoderErr
+		}
+		data, err := zstdDecoder.DecodeAll(blob.GetZstdData(), make([]byte, 0, blob.GetRawSize()))
+		if err != nil {
+			return nil, err
+		}
+		return checkRawSize(blob, data)
+
+	case *OSMPBF.Blob_Lz4Data:
+		data, err := decompressLZ4(blob.GetLz4Data(), int(blob.GetRawSize()))
+		if err != nil {
 			return nil, err
 		}
-		return buf.Bytes(), nil
+		return checkRawSize(blob, data)
 
+	case *OSMPBF.Blob_LzmaData:
+		r, err := lzma.NewReader(bytes.NewReader(blob.GetLzmaData()))
+		if err != nil {
+			return nil, err
+		}
+		buf := bytes.NewBuffer(make([]byte, 0, blob.GetRawSize()+bytes.MinRead))
+		_, err = buf.ReadFrom(limitRawSize(blob, r))
+		if err != nil {
+			return nil, err
+		}
+		return checkRawSize(blob, buf.Bytes())
+
+	default:
+		return nil, fmt.Errorf("%w %T", ErrUnsupportedCompression, blob.Data)
+	}
+}
+
+// Return name of blob compression as in SupportedCompressions.
+func blobCompression(blob *OSMPBF.Blob) string {
+	switch blob.Data.(type) {
+	case *OSMPBF.Blob_Raw:
+		return "raw"
+	case *OSMPBF.Blob_ZlibData:
+		return "zlib"
+	case *OSMPBF.Blob_LzmaData:
+		return "lzma"
+	case *OSMPBF.Blob_OBSOLETEBzip2Data:
+		return "bzip2"
+	case *OSMPBF.Blob_Lz4Data:
+		return "lz4"
+	case *OSMPBF.Blob_ZstdData:
+		return "zstd"
 	default:
-		return nil, fmt.Errorf("unhandled blob data type %T", blob.Data)
+		return ""
+	}
+}
+
+// Check raw_size before it is used for allocation of decompression buffer.
+func checkRawSizeRange(blob *OSMPBF.Blob) error {
+	if size := blob.GetRawSize(); size < 0 || size > MaxBlobSize {
+		return fmt.Errorf("%w: raw_size %d out of range [0, %d]", ErrInvalidBlock, size, MaxBlobSize)
 	}
+	return nil
+}
+
+// Limit decompressed data to one byte more than raw_size, enough for checkRawSize to fail.
+func limitRawSize(blob *OSMPBF.Blob, r io.Reader) io.Reader {
+	return io.LimitReader(r, int64(blob.GetRawSize())+1)
+}
+
+func checkRawSize(blob *OSMPBF.Blob, data []byte) ([]byte, error) {
+	if len(data) != int(blob.GetRawSize()) {
+		return nil, fmt.Errorf("%w: %d but expected %d", ErrRawSizeMismatch, len(data), blob.GetRawSize())
+	}
+	return data, nil
 }
 
 func (dec *Decoder) readOSMHeader() error {
@@ -338,7 +964,8 @@ func (dec *Decoder) readOSMHeader() error {
 			if blobHeader.GetType() == "OSMHeader" {
 				err = dec.decodeOSMHeader(blob)
 			} else {
-				err = fmt.Errorf("unexpected first fileblock of type %s", blobHeader.GetType())
+				err = &DecodeError{0, 0, blobHeader.GetType(), StageBlobHeader,
+					fmt.Errorf("%w %s", ErrUnexpectedBlobType, blobHeader.GetType())}
 			}
 		}
 	})
@@ -346,23 +973,30 @@ func (dec *Decoder) readOSMHeader() error {
 	return err
 }
 
+// Decode the first fileblock. Errors are reported as *DecodeError.
 func (dec *Decoder) decodeOSMHeader(blob *OSMPBF.Blob) error {
 	data, err := getData(blob)
 	if err != nil {
-		return err
+		return &DecodeError{0, 0, "OSMHeader", StageDecompress, err}
 	}
 
 	headerBlock := new(OSMPBF.HeaderBlock)
 	if err := proto.Unmarshal(data, headerBlock); err != nil {
-		return err
+		return &DecodeError{0, 0, "OSMHeader", StageHeaderBlock, err}
 	}
 
 	// Check we have the parse capabilities
+	var unknownFeatures []string
 	requiredFeatures := headerBlock.GetRequiredFeatures()
 	for _, feature := range requiredFeatures {
-		if !parseCapabilities[feature] {
-			return fmt.Errorf("parser does not have %s capability", feature)
+		if parseCapabilities[feature] || dec.capabilities[feature] {
+			continue
+		}
+		if !dec.allowUnknownFeatures {
+			return &DecodeError{0, 0, "OSMHeader", StageHeaderBlock,
+				fmt.Errorf("%w: parser does not have %s capability", ErrUnsupportedFeature, feature)}
 		}
+		unknownFeatures = append(unknownFeatures, feature)
 	}
 
 	// Read properties to header struct
@@ -373,6 +1007,7 @@ func (dec *Decoder) decodeOSMHeader(blob *OSMPBF.Blob) error {
 		Source:                           headerBlock.GetSource(),
 		OsmosisReplicationBaseUrl:        headerBlock.GetOsmosisReplicationBaseUrl(),
 		OsmosisReplicationSequenceNumber: headerBlock.GetOsmosisReplicationSequenceNumber(),
+		UnknownRequiredFeatures:          unknownFeatures,
 	}
 
 	// convert timestamp epoch seconds to golang time structure if it exists
@@ -0,0 +1,259 @@
+package osmpbf
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/qedus/osmpbf/OSMPBF"
+)
+
+// StrictValidation makes Decoder check that PrimitiveBlocks conform to the specification
+// beyond what is needed for decoding: positive granularity, valid coordinates, delta coded
+// values without overflow and stringtable of valid UTF-8 starting with an empty string.
+// Violations are reported as *DecodeError wrapping ErrInvalidBlock. It must be called before Start.
+func (dec *Decoder) StrictValidation() {
+	dec.options.strict = true
+}
+
+func invalidBlock(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidBlock, fmt.Sprintf(format, args...))
+}
+
+// Check array lengths and stringtable indexes used by parsing functions, so they can not panic.
+func checkPrimitiveGroup(n int, pg *OSMPBF.PrimitiveGroup) error {
+	for _, node := range pg.GetNodes() {
+		if err := checkTags(n, node.GetKeys(), node.GetVals()); err != nil {
+			return invalidBlock("node %d: %v", node.GetId(), err)
+		}
+		if err := checkInfo(n, node.GetInfo()); err != nil {
+			return invalidBlock("node %d: %v", node.GetId(), err)
+		}
+	}
+
+	if err := checkDenseNodes(n, pg.GetDense()); err != nil {
+		return invalidBlock("dense nodes: %v", err)
+	}
+
+	for _, way := range pg.GetWays() {
+		if err := checkTags(n, way.GetKeys(), way.GetVals()); err != nil {
+			return invalidBlock("way %d: %v", way.GetId(), err)
+		}
+		if err := checkInfo(n, way.GetInfo()); err != nil {
+			return invalidBlock("way %d: %v", way.GetId(), err)
+		}
+	}
+
+	for _, rel := range pg.GetRelations() {
+		if err := checkTags(n, rel.GetKeys(), rel.GetVals()); err != nil {
+			return invalidBlock("relation %d: %v", rel.GetId(), err)
+		}
+		if err := checkInfo(n, rel.GetInfo()); err != nil {
+			return invalidBlock("relation %d: %v", rel.GetId(), err)
+		}
+		if err := checkMembers(n, rel); err != nil {
+			return invalidBlock("relation %d: %v", rel.GetId(), err)
+		}
+	}
+	return nil
+}
+
+func checkStringIndex(n int, id int64) error {
+	if id < 0 || id >= int64(n) {
+		return fmt.Errorf("string index %d out of range [0, %d)", id, n)
+	}
+	return nil
+}
+
+func checkTags(n int, keyIDs, valueIDs []uint32) error {
+	if len(keyIDs) != len(valueIDs) {
+		return fmt.Errorf("%d keys but %d vals", len(keyIDs), len(valueIDs))
+	}
+	for index := range keyIDs {
+		if err := checkStringIndex(n, int64(keyIDs[index])); err != nil {
+			return err
+		}
+		if err := checkStringIndex(n, int64(valueIDs[index])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkInfo(n int, info *OSMPBF.Info) error {
+	if info == nil {
+		return nil
+	}
+	return checkStringIndex(n, int64(info.GetUserSid()))
+}
+
+func checkMembers(n int, rel *OSMPBF.Relation) error {
+	memIDs := rel.GetMemids()
+	types := rel.GetTypes()
+	roleIDs := rel.GetRolesSid()
+	if len(types) != len(memIDs) || len(roleIDs) != len(memIDs) {
+		return fmt.Errorf("%d memids but %d types and %d roles_sid", len(memIDs), len(types), len(roleIDs))
+	}
+	for index := range memIDs {
+		switch types[index] {
+		case OSMPBF.Relation_NODE, OSMPBF.Relation_WAY, OSMPBF.Relation_RELATION:
+		default:
+			return fmt.Errorf("unknown member type %d", types[index])
+		}
+		if err := checkStringIndex(n, int64(roleIDs[index])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkDenseNodes(n int, dn *OSMPBF.DenseNodes) error {
+	count := len(dn.GetId())
+	if len(dn.GetLat()) != count || len(dn.GetLon()) != count {
+		return fmt.Errorf("%d ids but %d lats and %d lons", count, len(dn.GetLat()), len(dn.GetLon()))
+	}
+
+	for _, id := range dn.GetKeysVals() {
+		if err := checkStringIndex(n, int64(id)); err != nil {
+			return err
+		}
+	}
+
+	di := dn.GetDenseinfo()
+	if di == nil {
+		return nil
+	}
+	for _, l := range []struct {
+		name   string
+		length int
+	}{
+		{"version", len(di.GetVersion())},
+		{"timestamp", len(di.GetTimestamp())},
+		{"changeset", len(di.GetChangeset())},
+		{"uid", len(di.GetUid())},
+		{"user_sid", len(di.GetUserSid())},
+		{"visible", len(di.GetVisible())},
+	} {
+		if l.length != 0 && l.length != count {
+			return fmt.Errorf("%d ids but %d %s values", count, l.length, l.name)
+		}
+	}
+	var userSid int64
+	for _, delta := range di.GetUserSid() {
+		userSid += int64(delta) // delta encoding
+		if err := checkStringIndex(n, userSid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add delta to sum and report overflow.
+func addDelta(sum, delta int64) (int64, bool) {
+	s := sum + delta
+	return s, (delta > 0 && s < sum) || (delta < 0 && s > sum)
+}
+
+// Check strict conformance to the specification, see Decoder.StrictValidation.
+func validatePrimitiveBlock(pb *OSMPBF.PrimitiveBlock) error {
+	st := pb.GetStringtable().GetS()
+	if len(st) > 0 && st[0] != "" {
+		return invalidBlock("stringtable starts with non-empty string %q", st[0])
+	}
+	for index, s := range st {
+		if !utf8.ValidString(s) {
+			return invalidBlock("stringtable string %d is not valid UTF-8", index)
+		}
+	}
+
+	if pb.GetGranularity() <= 0 {
+		return invalidBlock("granularity %d is not positive", pb.GetGranularity())
+	}
+	if pb.GetDateGranularity() <= 0 {
+		return invalidBlock("date_granularity %d is not positive", pb.GetDateGranularity())
+	}
+
+	v := coordinateValidator{
+		granularity: float64(pb.GetGranularity()),
+		latOffset:   float64(pb.GetLatOffset()),
+		lonOffset:   float64(pb.GetLonOffset()),
+	}
+	for _, pg := range pb.GetPrimitivegroup() {
+		for _, node := range pg.GetNodes() {
+			if err := v.check(node.GetLat(), node.GetLon()); err != nil {
+				return invalidBlock("node %d: %v", node.GetId(), err)
+			}
+		}
+		if err := v.checkDenseNodes(pg.GetDense()); err != nil {
+			return invalidBlock("dense nodes: %v", err)
+		}
+		for _, way := range pg.GetWays() {
+			if err := checkDeltas("refs", way.GetRefs()); err != nil {
+				return invalidBlock("way %d: %v", way.GetId(), err)
+			}
+			if err := v.checkDeltas(way.GetLat(), way.GetLon()); err != nil {
+				return invalidBlock("way %d: %v", way.GetId(), err)
+			}
+		}
+		for _, rel := range pg.GetRelations() {
+			if err := checkDeltas("memids", rel.GetMemids()); err != nil {
+				return invalidBlock("relation %d: %v", rel.GetId(), err)
+			}
+		}
+	}
+	return nil
+}
+
+func checkDeltas(name string, deltas []int64) error {
+	var sum int64
+	for _, delta := range deltas {
+		var overflow bool
+		if sum, overflow = addDelta(sum, delta); overflow {
+			return fmt.Errorf("delta coded %s overflow", name)
+		}
+	}
+	return nil
+}
+
+type coordinateValidator struct {
+	granularity float64
+	latOffset   float64
+	lonOffset   float64
+}
+
+// Check coordinate in granularity units.
+func (v *coordinateValidator) check(lat, lon int64) error {
+	latitude := 1e-9 * (v.latOffset + v.granularity*float64(lat))
+	longitude := 1e-9 * (v.lonOffset + v.granularity*float64(lon))
+	if latitude < -90 || latitude > 90 || longitude < -180 || longitude > 180 {
+		return fmt.Errorf("coordinate %f,%f out of range", latitude, longitude)
+	}
+	return nil
+}
+
+// Check delta coded coordinates.
+func (v *coordinateValidator) checkDeltas(lats, lons []int64) error {
+	var lat, lon int64
+	var overflow bool
+	for index := range lats {
+		if index >= len(lons) {
+			break
+		}
+		if lat, overflow = addDelta(lat, lats[index]); overflow {
+			return fmt.Errorf("delta coded lat overflow")
+		}
+		if lon, overflow = addDelta(lon, lons[index]); overflow {
+			return fmt.Errorf("delta coded lon overflow")
+		}
+		if err := v.check(lat, lon); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *coordinateValidator) checkDenseNodes(dn *OSMPBF.DenseNodes) error {
+	if err := checkDeltas("ids", dn.GetId()); err != nil {
+		return err
+	}
+	return v.checkDeltas(dn.GetLat(), dn.GetLon())
+}
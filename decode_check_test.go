@@ -0,0 +1,153 @@
+package osmpbf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/qedus/osmpbf/OSMPBF"
+	"google.golang.org/protobuf/proto"
+)
+
+// Decode PrimitiveBlock with given groups and stringtable.
+func decodePrimitiveBlock(t *testing.T, options decodeOptions, pb *OSMPBF.PrimitiveBlock) error {
+	if pb.Stringtable == nil {
+		pb.Stringtable = &OSMPBF.StringTable{S: []string{"", "a", "b"}}
+	}
+	data, err := proto.Marshal(pb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := &OSMPBF.Blob{RawSize: proto.Int32(int32(len(data))), Data: &OSMPBF.Blob_Raw{Raw: data}}
+	_, err = (&dataDecoder{options: options}).Decode(blob)
+	return err
+}
+
+func group(pg *OSMPBF.PrimitiveGroup) *OSMPBF.PrimitiveBlock {
+	return &OSMPBF.PrimitiveBlock{Primitivegroup: []*OSMPBF.PrimitiveGroup{pg}}
+}
+
+func TestDecodeInvalidBlock(t *testing.T) {
+	for name, pb := range map[string]*OSMPBF.PrimitiveBlock{
+		"node keys and vals": group(&OSMPBF.PrimitiveGroup{Nodes: []*OSMPBF.Node{
+			{Id: proto.Int64(1), Lat: proto.Int64(0), Lon: proto.Int64(0), Keys: []uint32{1, 2}, Vals: []uint32{1}},
+		}}),
+		"node key index": group(&OSMPBF.PrimitiveGroup{Nodes: []*OSMPBF.Node{
+			{Id: proto.Int64(1), Lat: proto.Int64(0), Lon: proto.Int64(0), Keys: []uint32{3}, Vals: []uint32{1}},
+		}}),
+		"node user": group(&OSMPBF.PrimitiveGroup{Nodes: []*OSMPBF.Node{
+			{Id: proto.Int64(1), Lat: proto.Int64(0), Lon: proto.Int64(0), Info: &OSMPBF.Info{UserSid: proto.Uint32(10)}},
+		}}),
+		"dense lats": group(&OSMPBF.PrimitiveGroup{Dense: &OSMPBF.DenseNodes{
+			Id: []int64{1, 1}, Lat: []int64{1}, Lon: []int64{1, 1},
+		}}),
+		"dense keys_vals": group(&OSMPBF.PrimitiveGroup{Dense: &OSMPBF.DenseNodes{
+			Id: []int64{1}, Lat: []int64{1}, Lon: []int64{1}, KeysVals: []int32{1, -1, 0},
+		}}),
+		"dense info": group(&OSMPBF.PrimitiveGroup{Dense: &OSMPBF.DenseNodes{
+			Id: []int64{1, 1}, Lat: []int64{1, 1}, Lon: []int64{1, 1},
+			Denseinfo: &OSMPBF.DenseInfo{Version: []int32{1}},
+		}}),
+		"dense user": group(&OSMPBF.PrimitiveGroup{Dense: &OSMPBF.DenseNodes{
+			Id: []int64{1, 1}, Lat: []int64{1, 1}, Lon: []int64{1, 1},
+			Denseinfo: &OSMPBF.DenseInfo{UserSid: []int32{2, 1}},
+		}}),
+		"way vals": group(&OSMPBF.PrimitiveGroup{Ways: []*OSMPBF.Way{
+			{Id: proto.Int64(1), Keys: []uint32{1}, Vals: []uint32{5}},
+		}}),
+		"relation members": group(&OSMPBF.PrimitiveGroup{Relations: []*OSMPBF.Relation{
+			{Id: proto.Int64(1), Memids: []int64{1, 2}, Types: []OSMPBF.Relation_MemberType{0, 0}, RolesSid: []int32{1}},
+		}}),
+		"relation role": group(&OSMPBF.PrimitiveGroup{Relations: []*OSMPBF.Relation{
+			{Id: proto.Int64(1), Memids: []int64{1}, Types: []OSMPBF.Relation_MemberType{0}, RolesSid: []int32{-1}},
+		}}),
+		"relation type": group(&OSMPBF.PrimitiveGroup{Relations: []*OSMPBF.Relation{
+			{Id: proto.Int64(1), Memids: []int64{1}, Types: []OSMPBF.Relation_MemberType{7}, RolesSid: []int32{1}},
+		}}),
+	} {
+		err := decodePrimitiveBlock(t, decodeOptions{}, pb)
+		var de *DecodeError
+		if !errors.Is(err, ErrInvalidBlock) || !errors.As(err, &de) || de.Stage != StagePrimitiveBlock {
+			t.Errorf("%s: expected invalid block error, got %v", name, err)
+		}
+	}
+}
+
+func TestDecodeStrictValidation(t *testing.T) {
+	valid := group(&OSMPBF.PrimitiveGroup{Dense: &OSMPBF.DenseNodes{
+		Id: []int64{1, 1}, Lat: []int64{515442632, 1}, Lon: []int64{-2010027, 1},
+	}})
+	if err := decodePrimitiveBlock(t, decodeOptions{strict: true}, valid); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, pb := range map[string]*OSMPBF.PrimitiveBlock{
+		"stringtable UTF-8": {Stringtable: &OSMPBF.StringTable{S: []string{"", "\xff"}}},
+		"stringtable start": {Stringtable: &OSMPBF.StringTable{S: []string{"a"}}},
+		"granularity":       {Granularity: proto.Int32(0)},
+		"date granularity":  {DateGranularity: proto.Int32(-1)},
+		"node latitude": group(&OSMPBF.PrimitiveGroup{Nodes: []*OSMPBF.Node{
+			{Id: proto.Int64(1), Lat: proto.Int64(900000001), Lon: proto.Int64(0)},
+		}}),
+		"lat offset": {LatOffset: proto.Int64(-91e9), Primitivegroup: []*OSMPBF.PrimitiveGroup{{Nodes: []*OSMPBF.Node{
+			{Id: proto.Int64(1), Lat: proto.Int64(0), Lon: proto.Int64(0)},
+		}}}},
+		"dense longitude": group(&OSMPBF.PrimitiveGroup{Dense: &OSMPBF.DenseNodes{
+			Id: []int64{1, 1}, Lat: []int64{0, 0}, Lon: []int64{1800000000, 1},
+		}}),
+		"dense ids": group(&OSMPBF.PrimitiveGroup{Dense: &OSMPBF.DenseNodes{
+			Id: []int64{1 << 62, 1 << 62}, Lat: []int64{0, 0}, Lon: []int64{0, 0},
+		}}),
+		"way refs": group(&OSMPBF.PrimitiveGroup{Ways: []*OSMPBF.Way{
+			{Id: proto.Int64(1), Refs: []int64{-1 << 62, -1 << 62, -1 << 62}},
+		}}),
+	} {
+		if err := decodePrimitiveBlock(t, decodeOptions{}, pb); err != nil {
+			t.Errorf("%s: unexpected error without strict validation: %v", name, err)
+		}
+		if err := decodePrimitiveBlock(t, decodeOptions{strict: true}, pb); !errors.Is(err, ErrInvalidBlock) {
+			t.Errorf("%s: expected invalid block error, got %v", name, err)
+		}
+	}
+}
+
+func TestGetDataRawSize(t *testing.T) {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	w.Write(make([]byte, 1<<20))
+	w.Close()
+	zlibData := buf.Bytes()
+
+	for _, blob := range []*OSMPBF.Blob{
+		{Data: &OSMPBF.Blob_ZlibData{ZlibData: zlibData}},
+		{Data: &OSMPBF.Blob_ZstdData{ZstdData: []byte{0}}},
+		{Data: &OSMPBF.Blob_Lz4Data{Lz4Data: []byte{0}}},
+		{Data: &OSMPBF.Blob_LzmaData{LzmaData: []byte{0}}},
+	} {
+		for _, rawSize := range []int32{-1, MaxBlobSize + 1} {
+			blob.RawSize = proto.Int32(rawSize)
+			if _, err := getData(blob); !errors.Is(err, ErrInvalidBlock) {
+				t.Errorf("%s raw_size %d: expected invalid block error, got %v", blobCompression(blob), rawSize, err)
+			}
+		}
+	}
+
+	// reused zlib reader and buffer
+	arenas := &sync.Pool{New: func() interface{} { return new(blockArena) }}
+	dd := &dataDecoder{options: decodeOptions{arenas: arenas}}
+	blob := &OSMPBF.Blob{RawSize: proto.Int32(-1), Data: &OSMPBF.Blob_ZlibData{ZlibData: zlibData}}
+	if _, err := dd.Decode(blob); !errors.Is(err, ErrInvalidBlock) {
+		t.Errorf("expected invalid block error, got %v", err)
+	}
+
+	// decompressed data larger than raw_size
+	blob.RawSize = proto.Int32(10)
+	if _, err := getData(blob); !errors.Is(err, ErrRawSizeMismatch) {
+		t.Errorf("expected raw size mismatch error, got %v", err)
+	}
+	if _, err := dd.Decode(blob); !errors.Is(err, ErrRawSizeMismatch) {
+		t.Errorf("expected raw size mismatch error, got %v", err)
+	}
+}
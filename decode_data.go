@@ -1,45 +1,210 @@
 package osmpbf
 
 import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"sync"
 	"time"
 
 	"github.com/qedus/osmpbf/OSMPBF"
-	"google.golang.org/protobuf/proto"
 )
 
 // Decoder for Blob with OSMData (PrimitiveBlock)
 type dataDecoder struct {
+	options decodeOptions
+
+	// tag filter resolved for current block
+	tagFilter *blockTagFilter
+
+	// memory of objects of current block in ReuseObjects mode
+	arena *blockArena
+	// decompression state reused in ReuseObjects mode
+	br  bytes.Reader
+	zr  io.ReadCloser
+	buf bytes.Buffer
+	// PrimitiveBlock reused for all blocks, since objects do not refer to it
+	pb pbBlock
+
 	q []interface{}
 }
 
+// Options controlling which data is decoded, see Decoder.Skip* methods.
+type decodeOptions struct {
+	skipNodes     bool
+	skipWays      bool
+	skipRelations bool
+	skipInfo      bool
+	skipTags      bool
+
+	tagFilter *TagFilter
+
+	// decode locations of skipped nodes for LocationStore
+	locations bool
+
+	// validate blocks, see Decoder.StrictValidation
+	strict bool
+
+	// pool of *blockArena, see Decoder.ReuseObjects
+	arenas *sync.Pool
+}
+
+// Decode objects of blob. Errors are *DecodeError without fileblock position.
+// In ReuseObjects mode objects are built in dec.arena, which the caller must return to the pool.
 func (dec *dataDecoder) Decode(blob *OSMPBF.Blob) ([]interface{}, error) {
-	dec.q = make([]interface{}, 0, 8000) // typical PrimitiveBlock contains 8k OSM entities
+	dec.arena = nil
+	if dec.options.arenas != nil {
+		dec.arena = dec.options.arenas.Get().(*blockArena)
+		dec.arena.reset()
+		dec.q = dec.arena.objects
+	} else {
+		dec.q = make([]interface{}, 0, 8000) // typical PrimitiveBlock contains 8k OSM entities
+	}
+
+	if err := dec.decode(blob); err != nil {
+		if dec.arena != nil {
+			dec.options.arenas.Put(dec.arena)
+			dec.arena = nil
+		}
+		return nil, err
+	}
+	if dec.arena != nil {
+		dec.arena.objects = dec.q
+	}
+	return dec.q, nil
+}
 
-	data, err := getData(blob)
+func (dec *dataDecoder) decode(blob *OSMPBF.Blob) error {
+	data, err := dec.getData(blob)
 	if err != nil {
+		return &DecodeError{Type: "OSMData", Stage: StageDecompress, Err: err}
+	}
+
+	primitiveBlock, err := dec.unmarshal(data)
+	if err != nil {
+		return &DecodeError{Type: "OSMData", Stage: StagePrimitiveBlock, Err: err}
+	}
+
+	if err := dec.parsePrimitiveBlock(primitiveBlock); err != nil {
+		return &DecodeError{Type: "OSMData", Stage: StagePrimitiveBlock, Err: err}
+	}
+	return nil
+}
+
+// Unmarshal PrimitiveBlock without fields skipped by options.
+func (dec *dataDecoder) unmarshal(data []byte) (*OSMPBF.PrimitiveBlock, error) {
+	dec.pb.skip = newPBSkip(dec.options)
+	if err := dec.pb.unmarshal(data); err != nil {
 		return nil, err
 	}
+	return &dec.pb.msg, nil
+}
 
-	primitiveBlock := &OSMPBF.PrimitiveBlock{}
-	if err := proto.Unmarshal(data, primitiveBlock); err != nil {
+// Decompress blob data, reusing buffer and zlib reader in ReuseObjects mode.
+func (dec *dataDecoder) getData(blob *OSMPBF.Blob) ([]byte, error) {
+	zlibData, ok := blob.Data.(*OSMPBF.Blob_ZlibData)
+	if dec.arena == nil || !ok {
+		return getData(blob)
+	}
+	if err := checkRawSizeRange(blob); err != nil {
 		return nil, err
 	}
 
-	dec.parsePrimitiveBlock(primitiveBlock)
-	return dec.q, nil
+	var err error
+	dec.br.Reset(zlibData.ZlibData)
+	if dec.zr == nil {
+		dec.zr, err = zlib.NewReader(&dec.br)
+	} else {
+		err = dec.zr.(zlib.Resetter).Reset(&dec.br, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	dec.buf.Reset()
+	dec.buf.Grow(int(blob.GetRawSize()) + bytes.MinRead)
+	if _, err = dec.buf.ReadFrom(limitRawSize(blob, dec.zr)); err != nil {
+		return nil, err
+	}
+	return checkRawSize(blob, dec.buf.Bytes())
 }
 
-func (dec *dataDecoder) parsePrimitiveBlock(pb *OSMPBF.PrimitiveBlock) {
+func (dec *dataDecoder) parsePrimitiveBlock(pb *OSMPBF.PrimitiveBlock) error {
+	if dec.options.strict {
+		if err := validatePrimitiveBlock(pb); err != nil {
+			return err
+		}
+	}
+
+	st := pb.GetStringtable().GetS()
+	dec.tagFilter = nil
+	if dec.options.tagFilter != nil {
+		dec.tagFilter = dec.options.tagFilter.resolve(st)
+	}
+
 	for _, pg := range pb.GetPrimitivegroup() {
+		if err := checkPrimitiveGroup(len(st), pg); err != nil {
+			return err
+		}
 		dec.parsePrimitiveGroup(pb, pg)
 	}
+	return nil
 }
 
 func (dec *dataDecoder) parsePrimitiveGroup(pb *OSMPBF.PrimitiveBlock, pg *OSMPBF.PrimitiveGroup) {
-	dec.parseNodes(pb, pg.GetNodes())
-	dec.parseDenseNodes(pb, pg.GetDense())
-	dec.parseWays(pb, pg.GetWays())
-	dec.parseRelations(pb, pg.GetRelations())
+	if !dec.options.skipNodes || dec.options.locations {
+		dec.parseNodes(pb, pg.GetNodes())
+		dec.parseDenseNodes(pb, pg.GetDense())
+	}
+	if !dec.options.skipWays {
+		dec.parseWays(pb, pg.GetWays())
+	}
+	if !dec.options.skipRelations {
+		dec.parseRelations(pb, pg.GetRelations())
+	}
+	if dec.tagFilter == nil {
+		// changesets have no tags, so they never match tag filter
+		dec.parseChangesets(pg.GetChangesets())
+	}
+}
+
+// Make tags map, or tag list in ReuseObjects mode, unless tags are skipped.
+func (dec *dataDecoder) extractTags(stringTable []string, keyIDs, valueIDs []uint32) (map[string]string, []Tag) {
+	if dec.options.skipTags {
+		return nil, nil
+	}
+	if dec.arena != nil {
+		tags := dec.arena.makeTags(len(keyIDs))
+		for index, keyID := range keyIDs {
+			tags[index] = Tag{stringTable[keyID], stringTable[valueIDs[index]]}
+		}
+		return nil, tags
+	}
+	return extractTags(stringTable, keyIDs, valueIDs), nil
+}
+
+// Make Info unless metadata is skipped.
+func (dec *dataDecoder) extractInfo(stringTable []string, i *OSMPBF.Info, dateGranularity int64) Info {
+	if dec.options.skipInfo {
+		return extractInfo(stringTable, nil, dateGranularity)
+	}
+	return extractInfo(stringTable, i, dateGranularity)
+}
+
+// Check whether node with given tags is returned to the caller.
+func (dec *dataDecoder) selectNode(keyIDs, valueIDs []uint32) bool {
+	if dec.options.skipNodes {
+		return false
+	}
+	return dec.tagFilter == nil || dec.tagFilter.match(NodeType, keyIDs, valueIDs)
+}
+
+// Keep location of node which is not returned to the caller if LocationStore needs it.
+func (dec *dataDecoder) skipNode(id int64, lat, lon float64) {
+	if dec.options.locations {
+		nl := dec.arena.newNodeLocation()
+		*nl = nodeLocation{id, Location{lat, lon}}
+		dec.q = append(dec.q, nl)
+	}
 }
 
 func (dec *dataDecoder) parseNodes(pb *OSMPBF.PrimitiveBlock, nodes []*OSMPBF.Node) {
@@ -58,10 +223,17 @@ func (dec *dataDecoder) parseNodes(pb *OSMPBF.PrimitiveBlock, nodes []*OSMPBF.No
 		latitude := 1e-9 * float64((latOffset + (granularity * lat)))
 		longitude := 1e-9 * float64((lonOffset + (granularity * lon)))
 
-		tags := extractTags(st, node.GetKeys(), node.GetVals())
-		info := extractInfo(st, node.GetInfo(), dateGranularity)
+		if !dec.selectNode(node.GetKeys(), node.GetVals()) {
+			dec.skipNode(id, latitude, longitude)
+			continue
+		}
+
+		tags, tagList := dec.extractTags(st, node.GetKeys(), node.GetVals())
+		info := dec.extractInfo(st, node.GetInfo(), dateGranularity)
 
-		dec.q = append(dec.q, &Node{id, latitude, longitude, tags, info})
+		n := dec.arena.newNode()
+		*n = Node{id, latitude, longitude, tags, info, tagList}
+		dec.q = append(dec.q, n)
 	}
 
 }
@@ -84,46 +256,93 @@ func (dec *dataDecoder) parseDenseNodes(pb *OSMPBF.PrimitiveBlock, dn *OSMPBF.De
 		id = ids[index] + id
 		lat = lats[index] + lat
 		lon = lons[index] + lon
+		keysVals := tu.nextKeysVals()
+
 		latitude := 1e-9 * float64((latOffset + (granularity * lat)))
 		longitude := 1e-9 * float64((lonOffset + (granularity * lon)))
-		tags := tu.next()
-		info := extractDenseInfo(st, &state, di, index, dateGranularity)
 
-		dec.q = append(dec.q, &Node{id, latitude, longitude, tags, info})
+		if dec.options.skipNodes || (dec.tagFilter != nil && !dec.tagFilter.matchKeysVals(NodeType, keysVals)) {
+			state.skip(di, index)
+			dec.skipNode(id, latitude, longitude)
+			continue
+		}
+		var tags map[string]string
+		var tagList []Tag
+		if !dec.options.skipTags {
+			if dec.arena != nil {
+				tagList = tu.tagList(keysVals, dec.arena.makeTags(len(keysVals)/2))
+			} else {
+				tags = tu.tags(keysVals)
+			}
+		}
+		info := Info{Visible: true}
+		if !dec.options.skipInfo {
+			info = extractDenseInfo(st, &state, di, index, dateGranularity)
+		}
+
+		n := dec.arena.newNode()
+		*n = Node{id, latitude, longitude, tags, info, tagList}
+		dec.q = append(dec.q, n)
 	}
 }
 
 func (dec *dataDecoder) parseWays(pb *OSMPBF.PrimitiveBlock, ways []*OSMPBF.Way) {
 	st := pb.GetStringtable().GetS()
+	granularity := int64(pb.GetGranularity())
+	latOffset := pb.GetLatOffset()
+	lonOffset := pb.GetLonOffset()
 	dateGranularity := int64(pb.GetDateGranularity())
 
 	for _, way := range ways {
+		if dec.tagFilter != nil && !dec.tagFilter.match(WayType, way.GetKeys(), way.GetVals()) {
+			continue
+		}
+
 		id := way.GetId()
 
-		tags := extractTags(st, way.GetKeys(), way.GetVals())
+		tags, tagList := dec.extractTags(st, way.GetKeys(), way.GetVals())
 
 		refs := way.GetRefs()
 		var nodeID int64
-		nodeIDs := make([]int64, len(refs))
+		nodeIDs := dec.arena.makeIDs(len(refs))
 		for index := range refs {
 			nodeID = refs[index] + nodeID // delta encoding
 			nodeIDs[index] = nodeID
 		}
 
-		info := extractInfo(st, way.GetInfo(), dateGranularity)
+		info := dec.extractInfo(st, way.GetInfo(), dateGranularity)
+
+		// LocationsOnWays optional feature
+		var locations []Location
+		lats := way.GetLat()
+		lons := way.GetLon()
+		if len(refs) > 0 && len(lats) == len(refs) && len(lons) == len(refs) {
+			var lat, lon int64
+			locations = dec.arena.makeLocations(len(refs))
+			for index := range refs {
+				lat = lats[index] + lat // delta encoding
+				lon = lons[index] + lon // delta encoding
+				locations[index] = Location{
+					Lat: 1e-9 * float64((latOffset + (granularity * lat))),
+					Lon: 1e-9 * float64((lonOffset + (granularity * lon))),
+				}
+			}
+		}
 
-		dec.q = append(dec.q, &Way{id, tags, nodeIDs, info})
+		w := dec.arena.newWay()
+		*w = Way{id, tags, nodeIDs, info, locations, tagList}
+		dec.q = append(dec.q, w)
 	}
 }
 
 // Make relation members from stringtable and three parallel arrays of IDs.
-func extractMembers(stringTable []string, rel *OSMPBF.Relation) []Member {
+func extractMembers(a *blockArena, stringTable []string, rel *OSMPBF.Relation) []Member {
 	memIDs := rel.GetMemids()
 	types := rel.GetTypes()
 	roleIDs := rel.GetRolesSid()
 
 	var memID int64
-	members := make([]Member, len(memIDs))
+	members := a.makeMembers(len(memIDs))
 	for index := range memIDs {
 		memID = memIDs[index] + memID // delta encoding
 
@@ -150,12 +369,26 @@ func (dec *dataDecoder) parseRelations(pb *OSMPBF.PrimitiveBlock, relations []*O
 	dateGranularity := int64(pb.GetDateGranularity())
 
 	for _, rel := range relations {
+		if dec.tagFilter != nil && !dec.tagFilter.match(RelationType, rel.GetKeys(), rel.GetVals()) {
+			continue
+		}
+
 		id := rel.GetId()
-		tags := extractTags(st, rel.GetKeys(), rel.GetVals())
-		members := extractMembers(st, rel)
-		info := extractInfo(st, rel.GetInfo(), dateGranularity)
+		tags, tagList := dec.extractTags(st, rel.GetKeys(), rel.GetVals())
+		members := extractMembers(dec.arena, st, rel)
+		info := dec.extractInfo(st, rel.GetInfo(), dateGranularity)
+
+		r := dec.arena.newRelation()
+		*r = Relation{id, tags, members, info, tagList}
+		dec.q = append(dec.q, r)
+	}
+}
 
-		dec.q = append(dec.q, &Relation{id, tags, members, info})
+func (dec *dataDecoder) parseChangesets(changesets []*OSMPBF.ChangeSet) {
+	for _, cs := range changesets {
+		c := dec.arena.newChangeset()
+		*c = Changeset{cs.GetId()}
+		dec.q = append(dec.q, c)
 	}
 }
 
@@ -189,6 +422,22 @@ type denseInfoState struct {
 	userSid   int32
 }
 
+// Accumulate delta coded values of skipped node.
+func (state *denseInfoState) skip(di *OSMPBF.DenseInfo, index int) {
+	if timestamps := di.GetTimestamp(); len(timestamps) > 0 {
+		state.timestamp = timestamps[index] + state.timestamp
+	}
+	if changesets := di.GetChangeset(); len(changesets) > 0 {
+		state.changeset = changesets[index] + state.changeset
+	}
+	if uids := di.GetUid(); len(uids) > 0 {
+		state.uid = uids[index] + state.uid
+	}
+	if usersids := di.GetUserSid(); len(usersids) > 0 {
+		state.userSid = usersids[index] + state.userSid
+	}
+}
+
 func extractDenseInfo(stringTable []string, state *denseInfoState, di *OSMPBF.DenseInfo, index int, dateGranularity int64) Info {
 	info := Info{Visible: true}
 
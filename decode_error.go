@@ -0,0 +1,111 @@
+package osmpbf
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrBlobHeaderTooLarge is returned for BlobHeader of size 64Kb or more.
+	ErrBlobHeaderTooLarge = errors.New("BlobHeader size >= 64Kb")
+
+	// ErrBlobTooLarge is returned for Blob of size 32Mb or more.
+	ErrBlobTooLarge = errors.New("Blob size >= 32Mb")
+
+	// ErrUnexpectedBlobType is returned for fileblock of type other than expected
+	// "OSMHeader" for the first fileblock or "OSMData" for the rest.
+	ErrUnexpectedBlobType = errors.New("unexpected fileblock of type")
+
+	// ErrUnsupportedCompression is returned for Blob with unknown or unsupported data field.
+	ErrUnsupportedCompression = errors.New("unsupported blob compression")
+
+	// ErrRawSizeMismatch is returned if decompressed Blob size differs from Blob raw_size.
+	ErrRawSizeMismatch = errors.New("raw blob data size mismatch")
+
+	// ErrInvalidBlock is returned for Blob or PrimitiveBlock with inconsistent or out of range data.
+	ErrInvalidBlock = errors.New("invalid PrimitiveBlock")
+
+	// ErrUnsupportedFeature is returned for file with required feature the Decoder does not support.
+	ErrUnsupportedFeature = errors.New("unsupported required feature")
+)
+
+// DecodeStage is a stage of fileblock decoding where DecodeError happened.
+type DecodeStage int
+
+const (
+	// StageBlobHeaderSize is reading of the 4-byte BlobHeader size.
+	StageBlobHeaderSize DecodeStage = iota + 1
+	// StageBlobHeader is reading and unmarshaling of BlobHeader.
+	StageBlobHeader
+	// StageBlob is reading and unmarshaling of Blob.
+	StageBlob
+	// StageDecompress is decompression of Blob data.
+	StageDecompress
+	// StageHeaderBlock is unmarshaling and checking of OSMHeader data.
+	StageHeaderBlock
+	// StagePrimitiveBlock is unmarshaling of OSMData data.
+	StagePrimitiveBlock
+)
+
+var decodeStageNames = [...]string{
+	StageBlobHeaderSize: "BlobHeader size",
+	StageBlobHeader:     "BlobHeader",
+	StageBlob:           "Blob",
+	StageDecompress:     "decompression",
+	StageHeaderBlock:    "HeaderBlock",
+	StagePrimitiveBlock: "PrimitiveBlock",
+}
+
+func (s DecodeStage) String() string {
+	if s > 0 && int(s) < len(decodeStageNames) {
+		return decodeStageNames[s]
+	}
+	return fmt.Sprintf("DecodeStage(%d)", int(s))
+}
+
+// DecodeError describes an error of reading or decoding a fileblock.
+// Truncated input is reported with Err equal to io.ErrUnexpectedEOF.
+type DecodeError struct {
+	// Index is the position of the fileblock in the file; the OSMHeader fileblock has index 0.
+	Index int64
+
+	// Offset is the position of the fileblock in the file in bytes.
+	Offset int64
+
+	// Type is BlobHeader type, empty if BlobHeader was not read.
+	Type string
+
+	Stage DecodeStage
+	Err   error
+}
+
+func (e *DecodeError) Error() string {
+	s := fmt.Sprintf("osmpbf: fileblock %d at offset %d", e.Index, e.Offset)
+	if e.Type != "" {
+		s += " (" + e.Type + ")"
+	}
+	return fmt.Sprintf("%s: %s: %v", s, e.Stage, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Return err as *DecodeError, wrapping it with given position if it is not one.
+func asDecodeError(err error, index, offset int64, blobType string, stage DecodeStage) *DecodeError {
+	var de *DecodeError
+	if errors.As(err, &de) {
+		return de
+	}
+	return &DecodeError{index, offset, blobType, stage, err}
+}
+
+// Set position of fileblock for DecodeError returned by dataDecoder.
+func positionError(err error, index, offset int64) error {
+	var de *DecodeError
+	if errors.As(err, &de) {
+		de.Index = index
+		de.Offset = offset
+	}
+	return err
+}
@@ -0,0 +1,192 @@
+package osmpbf
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TagFilter selects objects by their tags, similar to osmium tags-filter.
+// An object is selected if it matches any of the filter expressions.
+//
+// Expressions have form [TYPES/]KEY[=VALUES] or [TYPES/]KEY!=VALUES where
+// TYPES is any combination of "n", "w" and "r" selecting nodes, ways and relations
+// (all types if omitted), and VALUES is a comma-separated list of values.
+// Examples:
+//
+//	highway          objects with highway tag of any value
+//	highway=*        same as above
+//	w/highway=primary,secondary
+//	                 ways with highway tag equal to "primary" or "secondary"
+//	building!=no     objects with building tag of any value except "no"
+type TagFilter struct {
+	rules []tagRule
+
+	// index of each key and value used by rules
+	strings map[string]int32
+}
+
+type tagRule struct {
+	types  uint8 // bit set of MemberTypes
+	key    int32
+	values []int32 // empty for any value
+	negate bool    // match any value except values
+}
+
+// NewTagFilter returns a TagFilter for given expressions.
+func NewTagFilter(expressions ...string) (*TagFilter, error) {
+	f := &TagFilter{strings: make(map[string]int32)}
+	for _, expr := range expressions {
+		if err := f.add(expr); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (f *TagFilter) add(expr string) error {
+	r := tagRule{types: 1<<NodeType | 1<<WayType | 1<<RelationType}
+
+	s := expr
+	if i := strings.IndexByte(s, '/'); i > 0 && strings.Trim(s[:i], "nwr") == "" {
+		r.types = 0
+		for _, c := range s[:i] {
+			switch c {
+			case 'n':
+				r.types |= 1 << NodeType
+			case 'w':
+				r.types |= 1 << WayType
+			case 'r':
+				r.types |= 1 << RelationType
+			}
+		}
+		s = s[i+1:]
+	}
+
+	key, values := s, ""
+	if i := strings.Index(s, "!="); i >= 0 {
+		key, values = s[:i], s[i+2:]
+		r.negate = true
+	} else if i := strings.IndexByte(s, '='); i >= 0 {
+		key, values = s[:i], s[i+1:]
+		if values == "*" {
+			values = ""
+		}
+	}
+	if key == "" || (r.negate && values == "") {
+		return fmt.Errorf("invalid tag filter expression %q", expr)
+	}
+
+	r.key = f.index(key)
+	if values != "" {
+		for _, v := range strings.Split(values, ",") {
+			r.values = append(r.values, f.index(v))
+		}
+	}
+
+	f.rules = append(f.rules, r)
+	return nil
+}
+
+func (f *TagFilter) index(s string) int32 {
+	if i, ok := f.strings[s]; ok {
+		return i
+	}
+	i := int32(len(f.strings))
+	f.strings[s] = i
+	return i
+}
+
+// TagFilter resolved against stringtable of a PrimitiveBlock.
+type blockTagFilter struct {
+	*TagFilter
+
+	// filter string index for each stringtable ID, -1 if string is not used by filter
+	known []int32
+
+	// true if no rule key is present in stringtable, so nothing can match
+	empty bool
+}
+
+// Resolve filter strings to stringtable IDs once per block.
+func (f *TagFilter) resolve(stringTable []string) *blockTagFilter {
+	bf := &blockTagFilter{
+		TagFilter: f,
+		known:     make([]int32, len(stringTable)),
+		empty:     true,
+	}
+	keys := make(map[int32]bool, len(f.rules))
+	for _, r := range f.rules {
+		keys[r.key] = true
+	}
+
+	for id, s := range stringTable {
+		i, ok := f.strings[s]
+		if !ok || id == 0 {
+			bf.known[id] = -1
+			continue
+		}
+		bf.known[id] = i
+		if keys[i] {
+			bf.empty = false
+		}
+	}
+	return bf
+}
+
+// Check single tag given as stringtable IDs against all rules for type t.
+func (bf *blockTagFilter) matchTag(t MemberType, keyID, valID int) bool {
+	if keyID <= 0 || keyID >= len(bf.known) || bf.known[keyID] < 0 {
+		return false
+	}
+	key := bf.known[keyID]
+	val := int32(-1)
+	if valID > 0 && valID < len(bf.known) {
+		val = bf.known[valID]
+	}
+
+	for _, r := range bf.rules {
+		if r.types&(1<<t) == 0 || r.key != key {
+			continue
+		}
+		if len(r.values) == 0 {
+			return true
+		}
+		var found bool
+		for _, v := range r.values {
+			if v == val {
+				found = true
+				break
+			}
+		}
+		if found != r.negate {
+			return true
+		}
+	}
+	return false
+}
+
+// Check tags given as two parallel arrays of IDs.
+func (bf *blockTagFilter) match(t MemberType, keyIDs, valueIDs []uint32) bool {
+	if bf.empty {
+		return false
+	}
+	for index, keyID := range keyIDs {
+		if index < len(valueIDs) && bf.matchTag(t, int(keyID), int(valueIDs[index])) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check tags given as array of key and value IDs (used in DenseNodes encoding).
+func (bf *blockTagFilter) matchKeysVals(t MemberType, keysVals []int32) bool {
+	if bf.empty {
+		return false
+	}
+	for index := 0; index+1 < len(keysVals); index += 2 {
+		if bf.matchTag(t, int(keysVals[index]), int(keysVals[index+1])) {
+			return true
+		}
+	}
+	return false
+}
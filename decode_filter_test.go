@@ -0,0 +1,61 @@
+package osmpbf
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestTagFilter(t *testing.T) {
+	objects := []interface{}{
+		&Node{ID: 1, Tags: map[string]string{"amenity": "pub"}, Info: en.Info},
+		&Node{ID: 2, Tags: map[string]string{}, Info: ew.Info},
+		&Node{ID: 3, Tags: map[string]string{"highway": "crossing"}, Info: er.Info},
+		&Node{ID: 4, Tags: map[string]string{"building": "no"}, Info: en.Info},
+		&Way{ID: 1, Tags: map[string]string{"highway": "primary"}, NodeIDs: []int64{1, 2}, Info: ew.Info},
+		&Way{ID: 2, Tags: map[string]string{"building": "yes"}, NodeIDs: []int64{2, 3}, Info: ew.Info},
+		&Way{ID: 3, Tags: map[string]string{"building": "no"}, NodeIDs: []int64{3, 4}, Info: ew.Info},
+		&Way{ID: 4, Tags: map[string]string{"amenity": "pub"}, NodeIDs: []int64{1, 4}, Info: ew.Info},
+		&Relation{ID: 1, Tags: map[string]string{"highway": "pedestrian"}, Members: []Member{}, Info: er.Info},
+		&Relation{ID: 2, Tags: map[string]string{"type": "route"}, Members: []Member{}, Info: er.Info},
+	}
+
+	for _, test := range []struct {
+		expressions []string
+		expected    []int // indexes of objects
+	}{
+		{[]string{"highway"}, []int{2, 4, 8}},
+		{[]string{"highway=*"}, []int{2, 4, 8}},
+		{[]string{"w/highway"}, []int{4}},
+		{[]string{"nr/highway=crossing,pedestrian"}, []int{2, 8}},
+		{[]string{"building!=no"}, []int{5}},
+		{[]string{"n/amenity=pub", "type=route"}, []int{0, 9}},
+		{[]string{"highway=crossing"}, []int{2}},
+		{[]string{"name"}, nil},
+	} {
+		f, err := NewTagFilter(test.expressions...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d := NewDecoder(bytes.NewReader(encodePBF(t, nil, objects)))
+		d.SetTagFilter(f)
+
+		var expected []interface{}
+		for _, i := range test.expected {
+			expected = append(expected, objects[i])
+		}
+		actual := decodeAll(t, d)
+		if !reflect.DeepEqual(expected, actual) {
+			t.Errorf("%v:\nExpected: %#v\nActual:   %#v", test.expressions, expected, actual)
+		}
+	}
+}
+
+func TestTagFilterInvalid(t *testing.T) {
+	for _, expr := range []string{"", "=yes", "w/", "building!="} {
+		if _, err := NewTagFilter(expr); err == nil {
+			t.Errorf("%q: expected error", expr)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package osmpbf
+
+import "math"
+
+// A LocationStore keeps node locations, so that Decoder can resolve locations of way nodes.
+// Package github.com/qedus/osmpbf/locations provides implementations for different data sizes.
+// Decoder calls the methods from a single goroutine.
+type LocationStore interface {
+	// Set stores location of node with given ID.
+	Set(id int64, loc Location) error
+
+	// Get returns location of node with given ID and whether it was found.
+	Get(id int64) (Location, bool)
+}
+
+// Location of a node decoded only for LocationStore and not returned to the caller.
+type nodeLocation struct {
+	id  int64
+	loc Location
+}
+
+// SetLocationStore makes Decoder store locations of all nodes in s and fill Way.Locations
+// of ways which do not have them in the file. Locations of nodes missing in s are set to NaN.
+// Nodes removed by SkipNodes or tag filter are still stored. Nodes are expected before ways,
+// as in sorted files. It must be called before Start.
+func (dec *Decoder) SetLocationStore(s LocationStore) {
+	dec.locations = s
+	dec.options.locations = s != nil
+}
+
+// Store node locations and resolve way locations of a decoded block in file order.
+// Returns objects without nodes decoded only for the store.
+func (dec *Decoder) resolveLocations(a *blockArena, objects []interface{}) ([]interface{}, error) {
+	n := 0
+	for _, o := range objects {
+		switch o := o.(type) {
+		case *nodeLocation:
+			if err := dec.locations.Set(o.id, o.loc); err != nil {
+				return objects[:n], err
+			}
+			continue
+		case *Node:
+			if err := dec.locations.Set(o.ID, Location{o.Lat, o.Lon}); err != nil {
+				return objects[:n], err
+			}
+		case *Way:
+			if o.Locations == nil {
+				o.Locations = a.makeLocations(len(o.NodeIDs))
+				for index, id := range o.NodeIDs {
+					loc, ok := dec.locations.Get(id)
+					if !ok {
+						loc = Location{math.NaN(), math.NaN()}
+					}
+					o.Locations[index] = loc
+				}
+			}
+		}
+		objects[n] = o
+		n++
+	}
+	return objects[:n], nil
+}
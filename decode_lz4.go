@@ -0,0 +1,82 @@
+package osmpbf
+
+import (
+	"errors"
+)
+
+var errCorruptLZ4 = errors.New("corrupt LZ4 block")
+
+// Decompress LZ4 block format (without frame) into dst of known decompressed size.
+// See https://github.com/lz4/lz4/blob/dev/doc/lz4_Block_format.md
+func decompressLZ4(src []byte, rawSize int) ([]byte, error) {
+	if rawSize < 0 {
+		return nil, errCorruptLZ4
+	}
+	dst := make([]byte, 0, rawSize)
+
+	for si := 0; si < len(src); {
+		token := src[si]
+		si++
+
+		// literals
+		literalLen, n, err := lz4Length(src[si:], int(token>>4))
+		if err != nil {
+			return nil, err
+		}
+		si += n
+		if literalLen > len(src)-si {
+			return nil, errCorruptLZ4
+		}
+		dst = append(dst, src[si:si+literalLen]...)
+		si += literalLen
+
+		// last sequence contains only literals
+		if si == len(src) {
+			break
+		}
+
+		// match
+		if len(src)-si < 2 {
+			return nil, errCorruptLZ4
+		}
+		offset := int(src[si]) | int(src[si+1])<<8
+		si += 2
+		if offset == 0 || offset > len(dst) {
+			return nil, errCorruptLZ4
+		}
+
+		matchLen, n, err := lz4Length(src[si:], int(token&0x0f))
+		if err != nil {
+			return nil, err
+		}
+		si += n
+		matchLen += 4 // minimal match length
+
+		if len(dst)+matchLen > rawSize {
+			return nil, errCorruptLZ4
+		}
+		// copy byte by byte since match may overlap with itself
+		start := len(dst) - offset
+		for i := 0; i < matchLen; i++ {
+			dst = append(dst, dst[start+i])
+		}
+	}
+
+	return dst, nil
+}
+
+// Read length from token nibble and following extension bytes.
+// Returns length and number of extension bytes read.
+func lz4Length(src []byte, length int) (int, int, error) {
+	if length != 0x0f {
+		return length, 0, nil
+	}
+
+	for n, b := range src {
+		length += int(b)
+		if b != 0xff {
+			return length, n + 1, nil
+		}
+	}
+	return 0, 0, errCorruptLZ4
+}
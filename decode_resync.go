@@ -0,0 +1,152 @@
+package osmpbf
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"github.com/qedus/osmpbf/OSMPBF"
+	"google.golang.org/protobuf/proto"
+)
+
+// Loss describes fileblocks skipped by Decoder, see Decoder.SkipCorruptBlobs.
+type Loss struct {
+	// Blobs is the number of skipped fileblocks. Consecutive damaged fileblocks
+	// skipped while searching for the next BlobHeader are counted once.
+	Blobs int64
+
+	// Bytes is the size of skipped input in bytes.
+	Bytes int64
+}
+
+// SkipCorruptBlobs makes Decoder skip fileblocks which can not be read or decoded instead
+// of stopping with an error. If fileblock framing is damaged, the input is scanned for the
+// next valid BlobHeader. Each skipped fileblock is reported to f, if it is not nil; f is
+// called from a single decoding goroutine in file order. The OSMHeader fileblock must be
+// valid. It must be called before Header or Start.
+func (dec *Decoder) SkipCorruptBlobs(f func(err *DecodeError)) {
+	dec.skipCorrupt = true
+	dec.corruptHandler = f
+	dec.rr = &resyncReader{r: bufio.NewReaderSize(dec.r, 4+maxBlobHeaderSize)}
+	dec.r = dec.rr
+}
+
+// Loss returns the summary of fileblocks skipped so far by SkipCorruptBlobs mode.
+// It is safe to call while decoding runs; the summary is final after Decode returns io.EOF.
+func (dec *Decoder) Loss() Loss {
+	return Loss{dec.lostBlobs.Load(), dec.lostBytes.Load()}
+}
+
+// Record skipped fileblock in file order.
+func (dec *Decoder) reportCorrupt(db *decodedBlock) {
+	dec.lostBlobs.Add(1)
+	dec.lostBytes.Add(db.size)
+	if dec.corruptHandler != nil {
+		dec.corruptHandler(db.err)
+	}
+}
+
+// Reader with bytes pushed back for rescanning after a damaged fileblock.
+type resyncReader struct {
+	pending []byte
+	r       *bufio.Reader
+
+	scratch []byte
+}
+
+func (rr *resyncReader) Read(p []byte) (int, error) {
+	if len(rr.pending) > 0 {
+		n := copy(p, rr.pending)
+		rr.pending = rr.pending[n:]
+		return n, nil
+	}
+	return rr.r.Read(p)
+}
+
+// Return the next n bytes without advancing the reader.
+func (rr *resyncReader) peek(n int) ([]byte, error) {
+	if len(rr.pending) == 0 {
+		return rr.r.Peek(n)
+	}
+	if len(rr.pending) >= n {
+		return rr.pending[:n], nil
+	}
+	b, err := rr.r.Peek(n - len(rr.pending))
+	rr.scratch = append(append(rr.scratch[:0], rr.pending...), b...)
+	return rr.scratch, err
+}
+
+func (rr *resyncReader) discard() error {
+	if len(rr.pending) > 0 {
+		rr.pending = rr.pending[1:]
+		return nil
+	}
+	_, err := rr.r.Discard(1)
+	return err
+}
+
+// Skip fileblock at the current position with valid BlobHeader and damaged Blob. Blob data
+// is skipped as a whole, so that it is not scanned for BlobHeader.
+func (dec *Decoder) skipBlob() {
+	dec.index++
+	dec.offset += int64(dec.buf.Len())
+	dec.stats.bytesRead.Store(dec.offset)
+}
+
+// Skip fileblock with damaged BlobHeader at the current position: rescan its bytes read so far,
+// starting after the first one, and the rest of input until a plausible BlobHeader or the end of input.
+// Bytes scanned before a read error are skipped too.
+func (dec *Decoder) resync() error {
+	rr := dec.rr
+	if dec.buf.Len() > 1 {
+		rr.pending = append(append([]byte(nil), dec.buf.Bytes()[1:]...), rr.pending...)
+	}
+	skipped := int64(1)
+
+	for {
+		b, err := rr.peek(4)
+		if err == io.EOF || (err == nil && len(b) < 4) {
+			// skip the rest of input
+			for rr.discard() == nil {
+				skipped++
+			}
+			break
+		}
+		if err != nil && len(b) < 4 {
+			dec.skipped(skipped)
+			return err
+		}
+
+		if size := binary.BigEndian.Uint32(b); size > 0 && size < maxBlobHeaderSize {
+			if b, _ = rr.peek(4 + int(size)); len(b) == 4+int(size) && plausibleBlobHeader(b[4:]) {
+				break
+			}
+		}
+
+		if err = rr.discard(); err != nil {
+			dec.skipped(skipped)
+			return err
+		}
+		skipped++
+	}
+
+	dec.skipped(skipped)
+	return nil
+}
+
+// Advance position over fileblock skipped by resync.
+func (dec *Decoder) skipped(size int64) {
+	dec.index++
+	dec.offset += size
+	dec.stats.bytesRead.Store(dec.offset)
+}
+
+// Check whether data is BlobHeader of OSMData fileblock.
+func plausibleBlobHeader(data []byte) bool {
+	blobHeader := new(OSMPBF.BlobHeader)
+	if err := proto.Unmarshal(data, blobHeader); err != nil {
+		return false
+	}
+	size := blobHeader.GetDatasize()
+	return blobHeader.GetType() == "OSMData" && size > 0 && size < MaxBlobSize
+}
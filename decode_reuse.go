@@ -0,0 +1,216 @@
+package osmpbf
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	// returned by Decoder if ReuseObjects is called after Start
+	errReuseAfterStart = errors.New("ReuseObjects called after Start")
+
+	// returned by HistoryDecoder reading from Decoder in ReuseObjects mode
+	errHistoryReuse = errors.New("HistoryDecoder can not read objects reused by Decoder")
+)
+
+// Tag is a key and value of object tag, see Decoder.ReuseObjects.
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// ReuseObjects makes Decoder build objects in memory reused for later PrimitiveBlocks instead
+// of allocating every Node, Way and Relation with its slices and tags map. Tags are returned in
+// TagList field as key/value pairs, leaving Tags nil. In steady state, only strings of
+// stringtables of PrimitiveBlocks are allocated. Objects are only
+// borrowed by the caller: objects returned by Decode are valid until the next call to Decode,
+// objects passed to Handler by Run are valid until the method returns, and Block returned by
+// DecodeBlock is valid until the next call to DecodeBlock. Decode and DecodeBlock must be called
+// sequentially, and HistoryDecoder returns an error. It must be called before Start, otherwise
+// decoding methods return an error.
+func (dec *Decoder) ReuseObjects() {
+	if dec.ctx != nil {
+		// decoding goroutines already run without reuse
+		dec.usageErr = errReuseAfterStart
+		return
+	}
+	dec.options.arenas = &sync.Pool{
+		New: func() interface{} {
+			return new(blockArena)
+		},
+	}
+}
+
+// Return memory of decoded block to the pool once the caller is done with its objects.
+func (dec *Decoder) releaseBlock(db *decodedBlock) {
+	if db.arena != nil {
+		dec.options.arenas.Put(db.arena)
+		db.arena = nil
+	}
+}
+
+// Decode in ReuseObjects mode: objects are taken from the borrowed block directly,
+// so it is released only after the caller asks for an object of the next block.
+func (dec *Decoder) decodeBorrowed() (interface{}, error) {
+	dec.borrowMu.Lock()
+	defer dec.borrowMu.Unlock()
+
+	for {
+		if db := dec.borrowed; db != nil {
+			if dec.borrowedNext < len(db.objects) {
+				o := db.objects[dec.borrowedNext]
+				dec.borrowedNext++
+				return o, nil
+			}
+			dec.releaseBlock(db)
+			dec.borrowed = nil
+		}
+		if err := dec.borrowedErr; err != nil {
+			// send input or decoding error once, then io.EOF
+			dec.borrowedErr = nil
+			return nil, err
+		}
+
+		p, ok := <-dec.blobs
+		if !ok {
+			if err := dec.stopErr(); err != nil {
+				return nil, err
+			}
+			return nil, io.EOF
+		}
+		if p.i != nil {
+			dec.borrowed = p.i.(*decodedBlock)
+			dec.borrowedNext = 0
+		}
+		dec.borrowedErr = p.e
+	}
+}
+
+// Memory for objects of a single PrimitiveBlock in ReuseObjects mode. Methods of nil
+// blockArena allocate new memory, as Decoder does by default.
+type blockArena struct {
+	objects []interface{}
+	block   Block
+
+	nodes         slab[Node]
+	ways          slab[Way]
+	relations     slab[Relation]
+	changesets    slab[Changeset]
+	nodeLocations slab[nodeLocation]
+
+	ids       slab[int64]
+	locations slab[Location]
+	members   slab[Member]
+	tags      slab[Tag]
+}
+
+func (a *blockArena) reset() {
+	a.objects = a.objects[:0]
+	a.nodes.reset()
+	a.ways.reset()
+	a.relations.reset()
+	a.changesets.reset()
+	a.nodeLocations.reset()
+	a.ids.reset()
+	a.locations.reset()
+	a.members.reset()
+	a.tags.reset()
+}
+
+func (a *blockArena) newNode() *Node {
+	if a == nil {
+		return new(Node)
+	}
+	return &a.nodes.alloc(1)[0]
+}
+
+func (a *blockArena) newWay() *Way {
+	if a == nil {
+		return new(Way)
+	}
+	return &a.ways.alloc(1)[0]
+}
+
+func (a *blockArena) newRelation() *Relation {
+	if a == nil {
+		return new(Relation)
+	}
+	return &a.relations.alloc(1)[0]
+}
+
+func (a *blockArena) newChangeset() *Changeset {
+	if a == nil {
+		return new(Changeset)
+	}
+	return &a.changesets.alloc(1)[0]
+}
+
+func (a *blockArena) newNodeLocation() *nodeLocation {
+	if a == nil {
+		return new(nodeLocation)
+	}
+	return &a.nodeLocations.alloc(1)[0]
+}
+
+func (a *blockArena) makeIDs(n int) []int64 {
+	if a == nil {
+		return make([]int64, n)
+	}
+	return a.ids.alloc(n)
+}
+
+func (a *blockArena) makeLocations(n int) []Location {
+	if a == nil {
+		return make([]Location, n)
+	}
+	return a.locations.alloc(n)
+}
+
+func (a *blockArena) makeMembers(n int) []Member {
+	if a == nil {
+		return make([]Member, n)
+	}
+	return a.members.alloc(n)
+}
+
+func (a *blockArena) makeTags(n int) []Tag {
+	if a == nil {
+		return make([]Tag, n)
+	}
+	return a.tags.alloc(n)
+}
+
+// Values allocated in chunks, so that pointers to them stay valid until reset.
+// Allocated values are not zeroed.
+type slab[T any] struct {
+	chunks  [][]T
+	current int // chunk being filled
+	used    int // number of values used in current chunk
+}
+
+func (s *slab[T]) alloc(n int) []T {
+	for {
+		if s.current < len(s.chunks) {
+			chunk := s.chunks[s.current]
+			if s.used+n <= len(chunk) {
+				v := chunk[s.used : s.used+n : s.used+n]
+				s.used += n
+				return v
+			}
+			s.current++
+			s.used = 0
+			continue
+		}
+		size := maxBlockEntities
+		if n > size {
+			size = n
+		}
+		s.chunks = append(s.chunks, make([]T, size))
+	}
+}
+
+func (s *slab[T]) reset() {
+	s.current = 0
+	s.used = 0
+}
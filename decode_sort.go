@@ -0,0 +1,81 @@
+package osmpbf
+
+import (
+	"fmt"
+)
+
+var kindNames = [...]string{
+	nodeKind:      "node",
+	wayKind:       "way",
+	relationKind:  "relation",
+	changesetKind: "changeset",
+}
+
+// KnownFeatures holds optional features from Header.OptionalFeatures known to this package.
+type KnownFeatures struct {
+	HasMetadata     bool // "Has_Metadata"
+	SortTypeThenID  bool // "Sort.Type_then_ID"
+	SortGeographic  bool // "Sort.Geographic"
+	LocationsOnWays bool // "LocationsOnWays"
+}
+
+// KnownFeatures returns known optional features of the file.
+func (h *Header) KnownFeatures() KnownFeatures {
+	var f KnownFeatures
+	for _, feature := range h.OptionalFeatures {
+		switch feature {
+		case "Has_Metadata":
+			f.HasMetadata = true
+		case "Sort.Type_then_ID":
+			f.SortTypeThenID = true
+		case "Sort.Geographic":
+			f.SortGeographic = true
+		case "LocationsOnWays":
+			f.LocationsOnWays = true
+		}
+	}
+	return f
+}
+
+// Checks that objects are sorted by type, then by ID.
+type sortChecker struct {
+	// allow versions of the same object in history files
+	history bool
+
+	started bool
+	kind    int
+	id      int64
+}
+
+// Check objects of the next block. Returns number of objects in order and error for the first one out of order.
+func (sc *sortChecker) check(index int64, objects []interface{}) (int, error) {
+	for n, o := range objects {
+		kind, id, _ := objectKindID(o)
+		if sc.started && (kind < sc.kind || (kind == sc.kind && !sc.idAfter(id))) {
+			return n, fmt.Errorf("%w: %s %d after %s %d in fileblock %d",
+				ErrUnsorted, kindNames[kind], id, kindNames[sc.kind], sc.id, index)
+		}
+		sc.started, sc.kind, sc.id = true, kind, id
+	}
+	return len(objects), nil
+}
+
+// Check that id may follow the previous ID of the same kind.
+func (sc *sortChecker) idAfter(id int64) bool {
+	if id == sc.id {
+		return sc.history
+	}
+	return idLess(sc.id, id)
+}
+
+// Order of IDs used by osmium: negative IDs first ordered by absolute value, then positive IDs.
+func idLess(a, b int64) bool {
+	switch {
+	case a < 0 && b < 0:
+		return a > b
+	case a < 0 || b < 0:
+		return a < 0
+	default:
+		return a < b
+	}
+}
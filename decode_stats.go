@@ -0,0 +1,94 @@
+package osmpbf
+
+import (
+	"sync/atomic"
+
+	"github.com/qedus/osmpbf/OSMPBF"
+)
+
+// Stats is a snapshot of decoding progress, see Decoder.Stats.
+type Stats struct {
+	// BytesRead is the number of input bytes consumed, including skipped ones.
+	BytesRead int64
+
+	// BlobsRead is the number of fileblocks read, including the OSMHeader one.
+	BlobsRead int64
+
+	// BlobsDecoded is the number of OSMData fileblocks decoded successfully.
+	BlobsDecoded int64
+
+	// CompressedBytes and RawBytes are the sizes of data of decoded
+	// fileblocks as stored in the file and after decompression.
+	CompressedBytes int64
+	RawBytes        int64
+
+	// Number of objects of each type passed on in file order.
+	Nodes      int64
+	Ways       int64
+	Relations  int64
+	Changesets int64
+}
+
+type decodeStats struct {
+	bytesRead       atomic.Int64
+	blobsRead       atomic.Int64
+	blobsDecoded    atomic.Int64
+	compressedBytes atomic.Int64
+	rawBytes        atomic.Int64
+	objects         [changesetKind + 1]atomic.Int64
+}
+
+// Stats returns a snapshot of decoding progress. It is safe to call while decoding runs,
+// for example from a separate goroutine driving a progress bar; counters are updated
+// independently, so a snapshot taken during decoding may be slightly inconsistent.
+func (dec *Decoder) Stats() Stats {
+	s := &dec.stats
+	return Stats{
+		BytesRead:       s.bytesRead.Load(),
+		BlobsRead:       s.blobsRead.Load(),
+		BlobsDecoded:    s.blobsDecoded.Load(),
+		CompressedBytes: s.compressedBytes.Load(),
+		RawBytes:        s.rawBytes.Load(),
+		Nodes:           s.objects[nodeKind].Load(),
+		Ways:            s.objects[wayKind].Load(),
+		Relations:       s.objects[relationKind].Load(),
+		Changesets:      s.objects[changesetKind].Load(),
+	}
+}
+
+// Count successfully decoded OSMData blob.
+func (s *decodeStats) addBlob(blob *OSMPBF.Blob) {
+	var compressed int
+	raw := int64(blob.GetRawSize()) // checked by getData
+	switch data := blob.Data.(type) {
+	case *OSMPBF.Blob_Raw:
+		compressed = len(data.Raw)
+		raw = int64(compressed)
+	case *OSMPBF.Blob_ZlibData:
+		compressed = len(data.ZlibData)
+	case *OSMPBF.Blob_ZstdData:
+		compressed = len(data.ZstdData)
+	case *OSMPBF.Blob_Lz4Data:
+		compressed = len(data.Lz4Data)
+	case *OSMPBF.Blob_LzmaData:
+		compressed = len(data.LzmaData)
+	}
+	s.blobsDecoded.Add(1)
+	s.compressedBytes.Add(int64(compressed))
+	s.rawBytes.Add(raw)
+}
+
+// Count objects passed on in file order.
+func (s *decodeStats) addObjects(objects []interface{}) {
+	var counts [changesetKind + 1]int64
+	for _, o := range objects {
+		if kind, _, ok := objectKindID(o); ok {
+			counts[kind]++
+		}
+	}
+	for kind, n := range counts {
+		if n > 0 {
+			s.objects[kind].Add(n)
+		}
+	}
+}
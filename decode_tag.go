@@ -17,21 +17,36 @@ type tagUnpacker struct {
 	index       int
 }
 
-// Make tags map from stringtable and array of IDs (used in DenseNodes encoding).
-func (tu *tagUnpacker) next() map[string]string {
-	tags := make(map[string]string)
+// Return key and value IDs of the next node from array of IDs (used in DenseNodes encoding).
+func (tu *tagUnpacker) nextKeysVals() []int32 {
+	start := tu.index
 	for tu.index < len(tu.keysVals) {
-		keyID := tu.keysVals[tu.index]
-		tu.index++
-		if keyID == 0 {
-			break
+		if tu.keysVals[tu.index] == 0 {
+			tu.index++
+			return tu.keysVals[start : tu.index-1]
 		}
+		tu.index += 2
+	}
+	if tu.index > len(tu.keysVals) {
+		tu.index = len(tu.keysVals)
+	}
+	return tu.keysVals[start:tu.index]
+}
 
-		valID := tu.keysVals[tu.index]
-		tu.index++
+// Fill tag list from stringtable and key and value IDs of a single node.
+func (tu *tagUnpacker) tagList(keysVals []int32, tags []Tag) []Tag {
+	for index := range tags {
+		tags[index] = Tag{tu.stringTable[keysVals[2*index]], tu.stringTable[keysVals[2*index+1]]}
+	}
+	return tags
+}
 
-		key := tu.stringTable[keyID]
-		val := tu.stringTable[valID]
+// Make tags map from stringtable and key and value IDs of a single node.
+func (tu *tagUnpacker) tags(keysVals []int32) map[string]string {
+	tags := make(map[string]string, len(keysVals)/2)
+	for index := 0; index+1 < len(keysVals); index += 2 {
+		key := tu.stringTable[keysVals[index]]
+		val := tu.stringTable[keysVals[index+1]]
 		tags[key] = val
 	}
 	return tags
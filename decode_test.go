@@ -1,8 +1,13 @@
 package osmpbf
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"os"
 	"reflect"
@@ -11,7 +16,13 @@ import (
 	"sync"
 	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/qedus/osmpbf/OSMPBF"
+	"github.com/ulikunitz/xz/lzma"
+	"google.golang.org/protobuf/proto"
 )
 
 const (
@@ -514,3 +525,905 @@ func BenchmarkDecodeConcurrent(b *testing.B) {
 		b.SetBytes(fileInfo.Size())
 	}
 }
+
+func TestGetDataZstd(t *testing.T) {
+	raw := []byte("zstd compressed OSM data")
+
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed := enc.EncodeAll(raw, nil)
+
+	blob := &OSMPBF.Blob{
+		RawSize: proto.Int32(int32(len(raw))),
+		Data:    &OSMPBF.Blob_ZstdData{ZstdData: compressed},
+	}
+	data, err := getData(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(raw, data) {
+		t.Errorf("\nExpected: %q\nActual:   %q", raw, data)
+	}
+
+	blob.RawSize = proto.Int32(int32(len(raw) + 1))
+	if _, err = getData(blob); err == nil {
+		t.Error("expected raw size mismatch error")
+	}
+}
+
+func TestGetDataLZ4(t *testing.T) {
+	// literals "abc", match of 9 bytes at offset 3, final literals "xyz"
+	compressed := []byte{0x35, 'a', 'b', 'c', 0x03, 0x00, 0x30, 'x', 'y', 'z'}
+	raw := []byte("abcabcabcabcxyz")
+
+	blob := &OSMPBF.Blob{
+		RawSize: proto.Int32(int32(len(raw))),
+		Data:    &OSMPBF.Blob_Lz4Data{Lz4Data: compressed},
+	}
+	data, err := getData(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(raw, data) {
+		t.Errorf("\nExpected: %q\nActual:   %q", raw, data)
+	}
+
+	blob.Data = &OSMPBF.Blob_Lz4Data{Lz4Data: compressed[:5]}
+	if _, err = getData(blob); err == nil {
+		t.Error("expected corrupt block error")
+	}
+}
+
+func TestGetDataLZMA(t *testing.T) {
+	raw := []byte("lzma compressed OSM data")
+
+	var buf bytes.Buffer
+	w, err := lzma.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(raw); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	blob := &OSMPBF.Blob{
+		RawSize: proto.Int32(int32(len(raw))),
+		Data:    &OSMPBF.Blob_LzmaData{LzmaData: buf.Bytes()},
+	}
+	data, err := getData(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(raw, data) {
+		t.Errorf("\nExpected: %q\nActual:   %q", raw, data)
+	}
+}
+
+func manyNodes(n int) []interface{} {
+	objects := make([]interface{}, n)
+	for i := range objects {
+		objects[i] = &Node{ID: int64(i + 1), Tags: map[string]string{}, Info: en.Info}
+	}
+	return objects
+}
+
+func TestDecodeClose(t *testing.T) {
+	data := encodePBF(t, nil, manyNodes(10*maxBlockEntities))
+
+	d := NewDecoder(bytes.NewReader(data))
+	if err := d.Start(4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Decode(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Decode(); err != ErrDecoderClosed {
+		t.Errorf("expected %v, got %v", ErrDecoderClosed, err)
+	}
+	if err := d.Start(4); err != ErrDecoderClosed {
+		t.Errorf("expected %v, got %v", ErrDecoderClosed, err)
+	}
+}
+
+func TestDecodeContextCancel(t *testing.T) {
+	data := encodePBF(t, nil, manyNodes(10*maxBlockEntities))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := NewDecoder(bytes.NewReader(data))
+	if err := d.StartContext(ctx, 4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Decode(); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	if _, err := d.Decode(); err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecodeErrorStopsGoroutines(t *testing.T) {
+	data := encodePBF(t, nil, manyNodes(10*maxBlockEntities))
+	ir, err := NewIndexedReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// break zlib checksum at the end of the second OSMData fileblock
+	b := ir.Blobs()[2]
+	data[b.Offset+4+int64(b.HeaderSize)+int64(b.DataSize)-1] ^= 0xff
+
+	goroutines := runtime.NumGoroutine()
+	d := NewDecoder(bytes.NewReader(data))
+	if err := d.Start(4); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for {
+		if _, err = d.Decode(); err != nil {
+			break
+		}
+		n++
+	}
+	var de *DecodeError
+	if !errors.As(err, &de) || de.Index != 2 || n != maxBlockEntities {
+		t.Fatalf("expected decoding error of fileblock 2 after %d nodes, got %v after %d", maxBlockEntities, err, n)
+	}
+	if _, err = d.Decode(); err != io.EOF {
+		t.Errorf("expected %v, got %v", io.EOF, err)
+	}
+
+	// decoding goroutines exit without Close
+	for i := 0; runtime.NumGoroutine() > goroutines; i++ {
+		if i == 100 {
+			t.Fatalf("expected %d goroutines, got %d", goroutines, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type recordingHandler struct {
+	objects []interface{}
+}
+
+func (h *recordingHandler) Node(n *Node)           { h.objects = append(h.objects, n) }
+func (h *recordingHandler) Way(w *Way)             { h.objects = append(h.objects, w) }
+func (h *recordingHandler) Relation(r *Relation)   { h.objects = append(h.objects, r) }
+func (h *recordingHandler) Changeset(c *Changeset) { h.objects = append(h.objects, c) }
+
+func TestDecodeRun(t *testing.T) {
+	objects := append(manyNodes(2*maxBlockEntities), encodeObjects[2:]...)
+
+	d := NewDecoder(bytes.NewReader(encodePBF(t, nil, objects)))
+	if err := d.Start(4); err != nil {
+		t.Fatal(err)
+	}
+
+	h := new(recordingHandler)
+	if err := d.Run(h); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(objects, h.objects) {
+		t.Errorf("expected %d objects in file order, got %d", len(objects), len(h.objects))
+	}
+}
+
+func TestDecodeSkip(t *testing.T) {
+	d := NewDecoder(bytes.NewReader(encodePBF(t, nil, encodeObjects)))
+	d.SkipNodes()
+	d.SkipRelations()
+	d.SkipInfo()
+	d.SkipTags()
+
+	expected := []interface{}{
+		&Way{ID: ew.ID, NodeIDs: ew.NodeIDs, Info: Info{Visible: true}},
+	}
+	objects := decodeAll(t, d)
+	if !reflect.DeepEqual(expected, objects) {
+		t.Errorf("\nExpected: %#v\nActual:   %#v", expected, objects)
+	}
+}
+
+func TestDecodeBlock(t *testing.T) {
+	objects := append(manyNodes(2*maxBlockEntities+1), encodeObjects[2:]...)
+	data := encodePBF(t, nil, objects)
+
+	d := NewDecoder(bytes.NewReader(data))
+	if err := d.Start(4); err != nil {
+		t.Fatal(err)
+	}
+
+	var actual []interface{}
+	var counts [][3]int
+	for index := int64(1); ; index++ {
+		b, err := d.DecodeBlock()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if b.Index != index {
+			t.Errorf("expected block index %d, got %d", index, b.Index)
+		}
+		size := binary.BigEndian.Uint32(data[b.Offset:])
+		blobHeader := new(OSMPBF.BlobHeader)
+		if err = proto.Unmarshal(data[b.Offset+4:b.Offset+4+int64(size)], blobHeader); err != nil {
+			t.Fatal(err)
+		}
+		if blobHeader.GetType() != "OSMData" {
+			t.Errorf("expected OSMData fileblock at offset %d, got %s", b.Offset, blobHeader.GetType())
+		}
+
+		counts = append(counts, [3]int{len(b.Nodes), len(b.Ways), len(b.Relations)})
+		for _, n := range b.Nodes {
+			actual = append(actual, n)
+		}
+		for _, w := range b.Ways {
+			actual = append(actual, w)
+		}
+		for _, r := range b.Relations {
+			actual = append(actual, r)
+		}
+	}
+
+	expectedCounts := [][3]int{{maxBlockEntities, 0, 0}, {maxBlockEntities, 0, 0}, {1, 0, 0}, {0, 1, 0}, {0, 0, 1}}
+	if !reflect.DeepEqual(expectedCounts, counts) {
+		t.Errorf("\nExpected: %v\nActual:   %v", expectedCounts, counts)
+	}
+	if !reflect.DeepEqual(objects, actual) {
+		t.Errorf("expected %d objects in file order, got %d", len(objects), len(actual))
+	}
+}
+
+func TestDecodeRequiredFeatures(t *testing.T) {
+	header := &Header{
+		RequiredFeatures: []string{"OsmSchema-V0.6", "DenseNodes", "Custom-Feature", "Other-Feature"},
+	}
+	data := encodePBF(t, header, encodeObjects)
+
+	d := NewDecoder(bytes.NewReader(data))
+	if _, err := d.Header(); !errors.Is(err, ErrUnsupportedFeature) {
+		t.Errorf("expected unknown required feature error, got %v", err)
+	}
+
+	d = NewDecoder(bytes.NewReader(data))
+	d.AddCapabilities("Custom-Feature", "Other-Feature")
+	h, err := d.Header()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.UnknownRequiredFeatures != nil {
+		t.Errorf("expected no unknown required features, got %v", h.UnknownRequiredFeatures)
+	}
+
+	d = NewDecoder(bytes.NewReader(data))
+	d.AddCapabilities("Custom-Feature")
+	d.AllowUnknownFeatures()
+	h, err = d.Header()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"Other-Feature"}; !reflect.DeepEqual(expected, h.UnknownRequiredFeatures) {
+		t.Errorf("\nExpected: %v\nActual:   %v", expected, h.UnknownRequiredFeatures)
+	}
+	if objects := decodeAll(t, d); !reflect.DeepEqual(encodeObjects, objects) {
+		t.Errorf("\nExpected: %#v\nActual:   %#v", encodeObjects, objects)
+	}
+}
+
+func TestHeaderKnownFeatures(t *testing.T) {
+	h := &Header{OptionalFeatures: []string{"Sort.Type_then_ID", "LocationsOnWays", "timestamp=2014-03-24T21:55:02Z"}}
+	expected := KnownFeatures{SortTypeThenID: true, LocationsOnWays: true}
+	if actual := h.KnownFeatures(); actual != expected {
+		t.Errorf("\nExpected: %#v\nActual:   %#v", expected, actual)
+	}
+}
+
+func TestDecodeCheckSortOrder(t *testing.T) {
+	node := func(id int64) *Node {
+		return &Node{ID: id, Tags: map[string]string{}, Info: en.Info}
+	}
+
+	history := &Header{
+		RequiredFeatures: []string{"OsmSchema-V0.6", "DenseNodes", "HistoricalInformation"},
+	}
+
+	for _, test := range []struct {
+		header  *Header
+		objects []interface{}
+		valid   int // number of objects before the first one out of order
+	}{
+		{nil, []interface{}{node(-1), node(-2), node(1), node(2), ew, er, &Changeset{ID: 1}}, 7},
+		{nil, []interface{}{node(1), node(3), node(2), ew}, 2},
+		{nil, []interface{}{node(1), node(-1)}, 1},
+		{nil, []interface{}{node(1), er, ew}, 2},
+		{nil, []interface{}{node(1), node(1), node(2)}, 1},
+		{history, []interface{}{node(1), node(1), node(2), ew, ew}, 5},
+	} {
+		d := NewDecoder(bytes.NewReader(encodePBF(t, test.header, test.objects)))
+		d.CheckSortOrder()
+		if err := d.Start(2); err != nil {
+			t.Fatal(err)
+		}
+
+		var objects []interface{}
+		var err error
+		for {
+			var v interface{}
+			if v, err = d.Decode(); err != nil {
+				break
+			}
+			objects = append(objects, v)
+		}
+
+		if !reflect.DeepEqual(test.objects[:test.valid], objects) {
+			t.Errorf("expected %d objects in order, got %d", test.valid, len(objects))
+		}
+		if test.valid == len(test.objects) && err != io.EOF {
+			t.Errorf("expected %v, got %v", io.EOF, err)
+		}
+		if test.valid < len(test.objects) && !errors.Is(err, ErrUnsorted) {
+			t.Errorf("expected %v, got %v", ErrUnsorted, err)
+		}
+	}
+}
+
+func TestDecodeBlockCheckSortOrder(t *testing.T) {
+	nodes := manyNodes(3)
+	nodes[1], nodes[2] = nodes[2], nodes[1]
+	for _, reuse := range []bool{false, true} {
+		d := NewDecoder(bytes.NewReader(encodePBF(t, nil, nodes)))
+		d.CheckSortOrder()
+		if reuse {
+			d.ReuseObjects()
+		}
+		if err := d.Start(2); err != nil {
+			t.Fatal(err)
+		}
+
+		// nodes in order are returned with the error
+		b, err := d.DecodeBlock()
+		if !errors.Is(err, ErrUnsorted) {
+			t.Errorf("expected %v, got %v", ErrUnsorted, err)
+		}
+		if b == nil || len(b.Nodes) != 2 || b.Nodes[0].ID != nodes[0].(*Node).ID || b.Nodes[1].ID != nodes[1].(*Node).ID {
+			t.Errorf("expected 2 nodes in order, got %v", b)
+		}
+		if _, err = d.DecodeBlock(); err != io.EOF {
+			t.Errorf("expected %v, got %v", io.EOF, err)
+		}
+		if err = d.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+type mapLocationStore map[int64]Location
+
+func (s mapLocationStore) Set(id int64, loc Location) error { s[id] = loc; return nil }
+
+func (s mapLocationStore) Get(id int64) (Location, bool) { loc, ok := s[id]; return loc, ok }
+
+func TestDecodeLocationStore(t *testing.T) {
+	objects := []interface{}{
+		&Node{ID: 1, Lat: 51.5, Lon: -0.125, Tags: map[string]string{}, Info: en.Info},
+		&Node{ID: 2, Lat: 51.25, Lon: -0.25, Tags: map[string]string{"amenity": "pub"}, Info: en.Info},
+		&Node{ID: 3, Lat: -33.75, Lon: 151.5, Tags: map[string]string{}, Info: en.Info},
+		&Way{ID: 1, Tags: map[string]string{"highway": "primary"}, NodeIDs: []int64{1, 3, 4}, Info: ew.Info},
+	}
+
+	for _, setup := range []func(d *Decoder){
+		func(d *Decoder) {},
+		func(d *Decoder) { d.SkipNodes() },
+		func(d *Decoder) {
+			f, _ := NewTagFilter("w/highway")
+			d.SetTagFilter(f)
+		},
+	} {
+		store := make(mapLocationStore)
+		d := NewDecoder(bytes.NewReader(encodePBF(t, nil, objects)))
+		d.SetLocationStore(store)
+		setup(d)
+
+		decoded := decodeAll(t, d)
+		if len(store) != 3 {
+			t.Errorf("expected 3 stored locations, got %v", store)
+		}
+		w, ok := decoded[len(decoded)-1].(*Way)
+		if !ok {
+			t.Fatalf("expected way, got %#v", decoded[len(decoded)-1])
+		}
+		if len(w.Locations) != 3 || w.Locations[0] != (Location{51.5, -0.125}) ||
+			w.Locations[1] != (Location{-33.75, 151.5}) || !math.IsNaN(w.Locations[2].Lat) {
+			t.Errorf("unexpected way locations %v", w.Locations)
+		}
+		for _, o := range decoded[:len(decoded)-1] {
+			if _, ok := o.(*Node); !ok {
+				t.Errorf("unexpected object %#v", o)
+			}
+		}
+	}
+}
+
+// Append fileblock with given blob to PBF data.
+func appendFileBlock(t testing.TB, data []byte, blobType string, blob *OSMPBF.Blob) []byte {
+	blobData, err := proto.Marshal(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobHeaderData, err := proto.Marshal(&OSMPBF.BlobHeader{
+		Type:     proto.String(blobType),
+		Datasize: proto.Int32(int32(len(blobData))),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = binary.BigEndian.AppendUint32(bytes.Clone(data), uint32(len(blobHeaderData)))
+	data = append(data, blobHeaderData...)
+	return append(data, blobData...)
+}
+
+// Decode all objects and return the first error.
+func decodeErr(d *Decoder) error {
+	if err := d.Start(2); err != nil {
+		return err
+	}
+	defer d.Close()
+	for {
+		if _, err := d.Decode(); err != nil {
+			return err
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	data := encodePBF(t, nil, encodeObjects)
+	ir, err := NewIndexedReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs := ir.Blobs()
+	last := blobs[len(blobs)-1]
+	badZlib := &OSMPBF.Blob{RawSize: proto.Int32(10), Data: &OSMPBF.Blob_ZlibData{ZlibData: []byte("not zlib")}}
+
+	for _, test := range []struct {
+		data     []byte
+		expected DecodeError
+	}{
+		{
+			data[:len(data)-10],
+			DecodeError{last.Index, last.Offset, "OSMData", StageBlob, io.ErrUnexpectedEOF},
+		},
+		{
+			data[:last.Offset+2],
+			DecodeError{last.Index, last.Offset, "", StageBlobHeaderSize, io.ErrUnexpectedEOF},
+		},
+		{
+			appendFileBlock(t, data, "OSMData", badZlib),
+			DecodeError{last.Index + 1, int64(len(data)), "OSMData", StageDecompress, nil},
+		},
+		{
+			appendFileBlock(t, data, "OSMHeader", badZlib),
+			DecodeError{last.Index + 1, int64(len(data)), "OSMHeader", StageBlobHeader, ErrUnexpectedBlobType},
+		},
+		{
+			appendFileBlock(t, data, "OSMData", &OSMPBF.Blob{Data: &OSMPBF.Blob_OBSOLETEBzip2Data{}}),
+			DecodeError{last.Index + 1, int64(len(data)), "OSMData", StageDecompress, ErrUnsupportedCompression},
+		},
+	} {
+		err := decodeErr(NewDecoder(bytes.NewReader(test.data)))
+		var de *DecodeError
+		if !errors.As(err, &de) {
+			t.Errorf("expected DecodeError, got %v", err)
+			continue
+		}
+		if de.Index != test.expected.Index || de.Offset != test.expected.Offset ||
+			de.Type != test.expected.Type || de.Stage != test.expected.Stage {
+			t.Errorf("expected %v, got %v", &test.expected, de)
+		}
+		if test.expected.Err != nil && !errors.Is(err, test.expected.Err) {
+			t.Errorf("expected %v, got %v", test.expected.Err, de.Err)
+		}
+	}
+
+	// IndexedReader reports the same errors
+	data = appendFileBlock(t, data, "OSMData", badZlib)
+	ir, err = NewIndexedReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ir.ScanIDs(2)
+	var de *DecodeError
+	if !errors.As(err, &de) || de.Index != last.Index+1 || de.Stage != StageDecompress {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestDecodeSkipCorruptBlobs(t *testing.T) {
+	data := encodePBF(t, nil, manyNodes(4*maxBlockEntities))
+	ir, err := NewIndexedReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs := ir.Blobs() // header and 4 data fileblocks
+	b2, b3 := blobs[2], blobs[3]
+	size2 := b3.Offset - b2.Offset
+
+	garbage := bytes.Repeat([]byte{0, 0, 1, 0xff}, 100)
+	for _, test := range []struct {
+		name     string
+		data     func() []byte
+		loss     Loss
+		stage    DecodeStage
+		expected int // number of decoded nodes
+	}{
+		{"blob data", func() []byte {
+			d := bytes.Clone(data)
+			copy(d[b2.Offset+4+int64(b2.HeaderSize)+10:], garbage[:8])
+			return d
+		}, Loss{1, size2}, StageDecompress, 3 * maxBlockEntities},
+		{"BlobHeader in blob data", func() []byte {
+			fake, err := proto.Marshal(&OSMPBF.BlobHeader{Type: proto.String("OSMData"), Datasize: proto.Int32(5)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := bytes.Clone(data)
+			blobData := d[b2.Offset+4+int64(b2.HeaderSize) : b3.Offset]
+			blobData[0] = 0x07 // invalid wire type
+			binary.BigEndian.PutUint32(blobData[1:], uint32(len(fake)))
+			copy(blobData[5:], fake)
+			return d
+		}, Loss{1, size2}, StageBlob, 3 * maxBlockEntities},
+		{"BlobHeader size", func() []byte {
+			d := bytes.Clone(data)
+			binary.BigEndian.PutUint32(d[b2.Offset:], 0xffffffff)
+			return d
+		}, Loss{1, size2}, StageBlobHeaderSize, 3 * maxBlockEntities},
+		{"garbage between fileblocks", func() []byte {
+			d := append(bytes.Clone(data[:b2.Offset]), garbage...)
+			return append(d, data[b2.Offset:]...)
+		}, Loss{1, int64(len(garbage))}, StageBlobHeader, 4 * maxBlockEntities},
+		{"truncated", func() []byte {
+			return data[:len(data)-10]
+		}, Loss{1, int64(len(data)) - 10 - blobs[4].Offset}, StageBlob, 3 * maxBlockEntities},
+	} {
+		d := NewDecoder(bytes.NewReader(test.data()))
+		var reported []*DecodeError
+		d.SkipCorruptBlobs(func(err *DecodeError) {
+			reported = append(reported, err)
+		})
+		objects := decodeAll(t, d)
+
+		if len(objects) != test.expected {
+			t.Errorf("%s: expected %d nodes, got %d", test.name, test.expected, len(objects))
+		}
+		if loss := d.Loss(); loss != test.loss {
+			t.Errorf("%s: expected loss %+v, got %+v", test.name, test.loss, loss)
+		}
+		if len(reported) != 1 || reported[0].Stage != test.stage {
+			t.Errorf("%s: unexpected errors %v", test.name, reported)
+		}
+	}
+}
+
+func TestDecodeSkipCorruptBlobsReadError(t *testing.T) {
+	data := encodePBF(t, nil, manyNodes(2*maxBlockEntities))
+	garbage := bytes.Repeat([]byte{0, 0, 1, 0xff}, 100)
+	readErr := errors.New("read failed")
+	r := io.MultiReader(bytes.NewReader(data), bytes.NewReader(garbage), iotest.ErrReader(readErr))
+
+	d := NewDecoder(r)
+	var reported []*DecodeError
+	d.SkipCorruptBlobs(func(err *DecodeError) {
+		reported = append(reported, err)
+	})
+	if err := d.Start(2); err != nil {
+		t.Fatal(err)
+	}
+	var nodes int
+	var err error
+	for {
+		if _, err = d.Decode(); err != nil {
+			break
+		}
+		nodes++
+	}
+
+	// damaged fileblock is reported before the read error
+	if !errors.Is(err, readErr) {
+		t.Errorf("expected %v, got %v", readErr, err)
+	}
+	if nodes != 2*maxBlockEntities {
+		t.Errorf("expected %d nodes, got %d", 2*maxBlockEntities, nodes)
+	}
+	if len(reported) != 1 || reported[0].Offset != int64(len(data)) {
+		t.Errorf("unexpected errors %v", reported)
+	}
+	if loss := d.Loss(); loss.Blobs != 1 || loss.Bytes <= 0 {
+		t.Errorf("unexpected loss %+v", loss)
+	}
+}
+
+func TestDecodeStats(t *testing.T) {
+	objects := append(manyNodes(2*maxBlockEntities), &Way{ID: 1, NodeIDs: []int64{1, 2}}, &Way{ID: 2}, &Relation{ID: 1})
+	data := encodePBF(t, nil, objects)
+
+	d := NewDecoder(bytes.NewReader(data))
+	if s := d.Stats(); s != (Stats{}) {
+		t.Errorf("expected zero stats, got %+v", s)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// Stats must be safe to call while decoding runs
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				d.Stats()
+			}
+		}
+	}()
+	decodeAll(t, d)
+
+	s := d.Stats()
+	if s.BytesRead != int64(len(data)) || s.BlobsRead != 5 || s.BlobsDecoded != 4 {
+		t.Errorf("unexpected progress %+v", s)
+	}
+	if s.Nodes != 2*maxBlockEntities || s.Ways != 2 || s.Relations != 1 || s.Changesets != 0 {
+		t.Errorf("unexpected object counts %+v", s)
+	}
+	if s.CompressedBytes <= 0 || s.RawBytes <= s.CompressedBytes {
+		t.Errorf("unexpected sizes %+v", s)
+	}
+}
+
+// Objects of several blocks of each type for ReuseObjects tests and benchmarks.
+func taggedObjects(n int) []interface{} {
+	var objects []interface{}
+	for i := 1; i <= n; i++ {
+		objects = append(objects, &Node{ID: int64(i), Lat: 51.5, Lon: -0.1, Tags: map[string]string{
+			"amenity": "bench", "ref": strconv.Itoa(i),
+		}, Info: en.Info})
+	}
+	for i := 1; i <= n/2; i++ {
+		objects = append(objects, &Way{ID: int64(i), NodeIDs: []int64{int64(i), int64(i + 1), int64(i + 2)}, Tags: map[string]string{
+			"highway": "residential",
+		}, Info: en.Info})
+	}
+	for i := 1; i <= n/10; i++ {
+		objects = append(objects, &Relation{ID: int64(i), Members: []Member{{int64(i), WayType, "outer"}}, Tags: map[string]string{
+			"type": "multipolygon",
+		}, Info: en.Info})
+	}
+	return append(objects, &Changeset{ID: 1})
+}
+
+func tagMap(list []Tag) map[string]string {
+	tags := make(map[string]string, len(list))
+	for _, tag := range list {
+		tags[tag.Key] = tag.Value
+	}
+	return tags
+}
+
+// Copy object borrowed in ReuseObjects mode into the form decoded by default.
+func ownObject(o interface{}) interface{} {
+	switch o := o.(type) {
+	case *Node:
+		n := *o
+		n.Tags, n.TagList = tagMap(o.TagList), nil
+		return &n
+	case *Way:
+		w := *o
+		w.Tags, w.TagList = tagMap(o.TagList), nil
+		w.NodeIDs = append(make([]int64, 0, len(o.NodeIDs)), o.NodeIDs...)
+		return &w
+	case *Relation:
+		r := *o
+		r.Tags, r.TagList = tagMap(o.TagList), nil
+		r.Members = append(make([]Member, 0, len(o.Members)), o.Members...)
+		return &r
+	case *Changeset:
+		c := *o
+		return &c
+	}
+	return o
+}
+
+type owningHandler struct {
+	objects []interface{}
+}
+
+func (h *owningHandler) Node(n *Node)           { h.objects = append(h.objects, ownObject(n)) }
+func (h *owningHandler) Way(w *Way)             { h.objects = append(h.objects, ownObject(w)) }
+func (h *owningHandler) Relation(r *Relation)   { h.objects = append(h.objects, ownObject(r)) }
+func (h *owningHandler) Changeset(c *Changeset) { h.objects = append(h.objects, ownObject(c)) }
+
+func TestDecodeReuseObjects(t *testing.T) {
+	data := encodePBF(t, nil, taggedObjects(3*maxBlockEntities))
+	expected := decodeAll(t, NewDecoder(bytes.NewReader(data)))
+
+	start := func() *Decoder {
+		d := NewDecoder(bytes.NewReader(data))
+		d.ReuseObjects()
+		if err := d.Start(2); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	// Decode, with borrowed objects written back to PBF
+	var buf bytes.Buffer
+	e := NewEncoder(&buf, nil)
+	var objects []interface{}
+	d := start()
+	for {
+		v, err := d.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = e.Encode(v); err != nil {
+			t.Fatal(err)
+		}
+		objects = append(objects, ownObject(v))
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(objects, expected) {
+		t.Error("Decode: objects differ")
+	}
+	if encoded := decodeAll(t, NewDecoder(&buf)); !reflect.DeepEqual(encoded, expected) {
+		t.Error("Encode: objects differ")
+	}
+
+	// Run
+	h := new(owningHandler)
+	if err := start().Run(h); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(h.objects, expected) {
+		t.Error("Run: objects differ")
+	}
+
+	// DecodeBlock
+	objects = nil
+	d = start()
+	for {
+		b, err := d.DecodeBlock()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range b.Nodes {
+			objects = append(objects, ownObject(n))
+		}
+		for _, w := range b.Ways {
+			objects = append(objects, ownObject(w))
+		}
+		for _, r := range b.Relations {
+			objects = append(objects, ownObject(r))
+		}
+		for _, c := range b.Changesets {
+			objects = append(objects, ownObject(c))
+		}
+	}
+	if !reflect.DeepEqual(objects, expected) {
+		t.Error("DecodeBlock: objects differ")
+	}
+}
+
+func TestDecodeReuseObjectsMisuse(t *testing.T) {
+	data := encodePBF(t, nil, taggedObjects(10))
+
+	d := NewDecoder(bytes.NewReader(data))
+	if err := d.Start(2); err != nil {
+		t.Fatal(err)
+	}
+	d.ReuseObjects()
+	if _, err := d.Decode(); err != errReuseAfterStart {
+		t.Errorf("expected %v, got %v", errReuseAfterStart, err)
+	}
+	d.Close()
+
+	d = NewDecoder(bytes.NewReader(data))
+	d.ReuseObjects()
+	if err := d.Start(2); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if _, err := NewHistoryDecoder(d).Decode(); err != errHistoryReuse {
+		t.Errorf("expected %v, got %v", errHistoryReuse, err)
+	}
+}
+
+// Decode a whole file; every iteration starts a new Decoder, so in ReuseObjects mode the memory
+// of first blocks is allocated again. See BenchmarkDecodeBlockReuseObjects for the steady state.
+func benchmarkDecodeObjects(b *testing.B, reuse bool) {
+	data := encodePBF(b, nil, taggedObjects(10*maxBlockEntities))
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d := NewDecoder(bytes.NewReader(data))
+		if reuse {
+			d.ReuseObjects()
+		}
+		if err := d.Start(runtime.GOMAXPROCS(-1)); err != nil {
+			b.Fatal(err)
+		}
+		for {
+			if _, err := d.Decode(); err == io.EOF {
+				break
+			} else if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkDecodeObjects(b *testing.B) {
+	benchmarkDecodeObjects(b, false)
+}
+
+func BenchmarkDecodeReuseObjects(b *testing.B) {
+	benchmarkDecodeObjects(b, true)
+}
+
+// Decode the same PrimitiveBlock repeatedly with one dataDecoder.
+func benchmarkDecodeBlock(b *testing.B, reuse bool) {
+	d := NewDecoder(bytes.NewReader(encodePBF(b, nil, taggedObjects(maxBlockEntities))))
+	if _, _, err := d.readFileBlock(); err != nil {
+		b.Fatal(err)
+	}
+	_, blob, err := d.readFileBlock()
+	if err != nil {
+		b.Fatal(err)
+	}
+	if reuse {
+		d.ReuseObjects()
+	}
+	dd := &dataDecoder{options: d.options}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := dd.Decode(blob); err != nil {
+			b.Fatal(err)
+		}
+		if dd.arena != nil {
+			dd.options.arenas.Put(dd.arena)
+		}
+	}
+}
+
+func BenchmarkDecodeBlock(b *testing.B) {
+	benchmarkDecodeBlock(b, false)
+}
+
+func BenchmarkDecodeBlockReuseObjects(b *testing.B) {
+	benchmarkDecodeBlock(b, true)
+}
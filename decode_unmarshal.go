@@ -0,0 +1,592 @@
+package osmpbf
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/qedus/osmpbf/OSMPBF"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// PrimitiveBlock reused by dataDecoder. Unlike proto.Unmarshal, unmarshal keeps messages,
+// repeated fields and optional scalar fields of previous blocks and fills them again, so that
+// only strings of stringtable are allocated for each block. Fields not needed by decodeOptions
+// are skipped without unpacking.
+type pbBlock struct {
+	msg         OSMPBF.PrimitiveBlock
+	stringtable OSMPBF.StringTable
+	groups      []*pbGroup
+	skip        pbSkip
+
+	granularity     int32
+	dateGranularity int32
+	latOffset       int64
+	lonOffset       int64
+}
+
+// Fields of PrimitiveBlock skipped by pbBlock.
+type pbSkip struct {
+	nodes, ways, relations, changesets bool
+
+	tags, info bool
+	// tags and info of nodes parsed only for LocationStore
+	nodeTags, nodeInfo bool
+}
+
+func newPBSkip(o decodeOptions) pbSkip {
+	// tags are needed by tag filter
+	tags := o.skipTags && o.tagFilter == nil
+	return pbSkip{
+		nodes:     o.skipNodes && !o.locations,
+		ways:      o.skipWays,
+		relations: o.skipRelations,
+		// changesets have no tags, so they never match tag filter
+		changesets: o.tagFilter != nil,
+
+		tags:     tags,
+		info:     o.skipInfo,
+		nodeTags: tags || o.skipNodes,
+		nodeInfo: o.skipInfo || o.skipNodes,
+	}
+}
+
+type pbGroup struct {
+	msg        OSMPBF.PrimitiveGroup
+	nodes      []*pbNode
+	dense      pbDenseNodes
+	ways       []*pbWay
+	relations  []*pbRelation
+	changesets []*pbChangeSet
+}
+
+type pbNode struct {
+	msg  OSMPBF.Node
+	info pbInfo
+
+	id, lat, lon int64
+}
+
+type pbDenseNodes struct {
+	msg  OSMPBF.DenseNodes
+	info OSMPBF.DenseInfo
+}
+
+type pbWay struct {
+	msg  OSMPBF.Way
+	info pbInfo
+	id   int64
+}
+
+type pbRelation struct {
+	msg  OSMPBF.Relation
+	info pbInfo
+	id   int64
+}
+
+type pbChangeSet struct {
+	msg OSMPBF.ChangeSet
+	id  int64
+}
+
+type pbInfo struct {
+	msg OSMPBF.Info
+
+	version   int32
+	timestamp int64
+	changeset int64
+	uid       int32
+	userSid   uint32
+	visible   bool
+}
+
+// Field of protobuf message with value of varint or length-delimited wire type.
+type pbField struct {
+	num    protowire.Number
+	typ    protowire.Type
+	varint uint64
+	bytes  []byte
+}
+
+// Read the next field of message data. Fields of other wire types are skipped.
+func nextField(data []byte) (pbField, []byte, error) {
+	var f pbField
+	var n int
+	f.num, f.typ, n = protowire.ConsumeTag(data)
+	if n < 0 {
+		return f, nil, protowire.ParseError(n)
+	}
+	data = data[n:]
+
+	switch f.typ {
+	case protowire.VarintType:
+		f.varint, n = protowire.ConsumeVarint(data)
+	case protowire.BytesType:
+		f.bytes, n = protowire.ConsumeBytes(data)
+	default:
+		n = protowire.ConsumeFieldValue(f.num, f.typ, data)
+	}
+	if n < 0 {
+		return f, nil, protowire.ParseError(n)
+	}
+	return f, data[n:], nil
+}
+
+// Return the element of list at index n, allocating it if needed.
+func reuseElement[T any](list []*T, n int) ([]*T, *T) {
+	if n == len(list) {
+		list = append(list, new(T))
+	}
+	return list, list[n]
+}
+
+func requiredField(name string) error {
+	return fmt.Errorf("required field %s not set", name)
+}
+
+func zigzag64(v uint64) int64 { return protowire.DecodeZigZag(v) }
+
+func zigzag32(v uint64) int32 { return int32(protowire.DecodeZigZag(v & math.MaxUint32)) }
+
+func varint64(v uint64) int64 { return int64(v) }
+
+func varint32(v uint64) int32 { return int32(v) }
+
+func varintUint32(v uint64) uint32 { return uint32(v) }
+
+func varintBool(v uint64) bool { return v != 0 }
+
+func memberType(v uint64) OSMPBF.Relation_MemberType { return OSMPBF.Relation_MemberType(int32(v)) }
+
+// Append values of repeated scalar field in packed or unpacked encoding.
+func appendVarints[T any](dst []T, f pbField, convert func(uint64) T) ([]T, error) {
+	if f.typ == protowire.VarintType {
+		return append(dst, convert(f.varint)), nil
+	}
+	for b := f.bytes; len(b) > 0; {
+		v, n := protowire.ConsumeVarint(b)
+		if n < 0 {
+			return dst, protowire.ParseError(n)
+		}
+		dst = append(dst, convert(v))
+		b = b[n:]
+	}
+	return dst, nil
+}
+
+func (b *pbBlock) unmarshal(data []byte) error {
+	m := &b.msg
+	m.Stringtable = nil
+	m.Primitivegroup = m.Primitivegroup[:0]
+	m.Granularity = nil
+	m.DateGranularity = nil
+	m.LatOffset = nil
+	m.LonOffset = nil
+
+	for len(data) > 0 {
+		f, rest, err := nextField(data)
+		if err != nil {
+			return err
+		}
+		data = rest
+
+		switch {
+		case f.num == 1 && f.typ == protowire.BytesType:
+			if m.Stringtable == nil {
+				b.stringtable.S = b.stringtable.S[:0]
+				m.Stringtable = &b.stringtable
+			}
+			err = b.unmarshalStringTable(f.bytes)
+		case f.num == 2 && f.typ == protowire.BytesType:
+			var g *pbGroup
+			b.groups, g = reuseElement(b.groups, len(m.Primitivegroup))
+			err = g.unmarshal(f.bytes, &b.skip)
+			m.Primitivegroup = append(m.Primitivegroup, &g.msg)
+		case f.num == 17 && f.typ == protowire.VarintType:
+			b.granularity = int32(f.varint)
+			m.Granularity = &b.granularity
+		case f.num == 18 && f.typ == protowire.VarintType:
+			b.dateGranularity = int32(f.varint)
+			m.DateGranularity = &b.dateGranularity
+		case f.num == 19 && f.typ == protowire.VarintType:
+			b.latOffset = int64(f.varint)
+			m.LatOffset = &b.latOffset
+		case f.num == 20 && f.typ == protowire.VarintType:
+			b.lonOffset = int64(f.varint)
+			m.LonOffset = &b.lonOffset
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if m.Stringtable == nil {
+		return requiredField("OSMPBF.PrimitiveBlock.stringtable")
+	}
+	return nil
+}
+
+func (b *pbBlock) unmarshalStringTable(data []byte) error {
+	for len(data) > 0 {
+		f, rest, err := nextField(data)
+		if err != nil {
+			return err
+		}
+		data = rest
+		if f.num == 1 && f.typ == protowire.BytesType {
+			b.stringtable.S = append(b.stringtable.S, string(f.bytes))
+		}
+	}
+	return nil
+}
+
+func (g *pbGroup) unmarshal(data []byte, skip *pbSkip) error {
+	m := &g.msg
+	m.Nodes = m.Nodes[:0]
+	m.Dense = nil
+	m.Ways = m.Ways[:0]
+	m.Relations = m.Relations[:0]
+	m.Changesets = m.Changesets[:0]
+
+	for len(data) > 0 {
+		f, rest, err := nextField(data)
+		if err != nil {
+			return err
+		}
+		data = rest
+		if f.typ != protowire.BytesType {
+			continue
+		}
+
+		switch {
+		case f.num == 1 && !skip.nodes:
+			var n *pbNode
+			g.nodes, n = reuseElement(g.nodes, len(m.Nodes))
+			err = n.unmarshal(f.bytes, skip.nodeTags, skip.nodeInfo)
+			m.Nodes = append(m.Nodes, &n.msg)
+		case f.num == 2 && !skip.nodes:
+			if m.Dense == nil {
+				g.dense.reset()
+				m.Dense = &g.dense.msg
+			}
+			err = g.dense.unmarshal(f.bytes, skip.nodeTags, skip.nodeInfo)
+		case f.num == 3 && !skip.ways:
+			var w *pbWay
+			g.ways, w = reuseElement(g.ways, len(m.Ways))
+			err = w.unmarshal(f.bytes, skip.tags, skip.info)
+			m.Ways = append(m.Ways, &w.msg)
+		case f.num == 4 && !skip.relations:
+			var r *pbRelation
+			g.relations, r = reuseElement(g.relations, len(m.Relations))
+			err = r.unmarshal(f.bytes, skip.tags, skip.info)
+			m.Relations = append(m.Relations, &r.msg)
+		case f.num == 5 && !skip.changesets:
+			var c *pbChangeSet
+			g.changesets, c = reuseElement(g.changesets, len(m.Changesets))
+			err = c.unmarshal(f.bytes)
+			m.Changesets = append(m.Changesets, &c.msg)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *pbNode) unmarshal(data []byte, skipTags, skipInfo bool) error {
+	m := &n.msg
+	m.Id = nil
+	m.Keys = m.Keys[:0]
+	m.Vals = m.Vals[:0]
+	m.Info = nil
+	m.Lat = nil
+	m.Lon = nil
+
+	for len(data) > 0 {
+		f, rest, err := nextField(data)
+		if err != nil {
+			return err
+		}
+		data = rest
+
+		switch {
+		case f.num == 1 && f.typ == protowire.VarintType:
+			n.id = zigzag64(f.varint)
+			m.Id = &n.id
+		case f.num == 2 && !skipTags:
+			m.Keys, err = appendVarints(m.Keys, f, varintUint32)
+		case f.num == 3 && !skipTags:
+			m.Vals, err = appendVarints(m.Vals, f, varintUint32)
+		case f.num == 4 && f.typ == protowire.BytesType && !skipInfo:
+			if m.Info == nil {
+				n.info.reset()
+				m.Info = &n.info.msg
+			}
+			err = n.info.unmarshal(f.bytes)
+		case f.num == 8 && f.typ == protowire.VarintType:
+			n.lat = zigzag64(f.varint)
+			m.Lat = &n.lat
+		case f.num == 9 && f.typ == protowire.VarintType:
+			n.lon = zigzag64(f.varint)
+			m.Lon = &n.lon
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case m.Id == nil:
+		return requiredField("OSMPBF.Node.id")
+	case m.Lat == nil:
+		return requiredField("OSMPBF.Node.lat")
+	case m.Lon == nil:
+		return requiredField("OSMPBF.Node.lon")
+	}
+	return nil
+}
+
+func (d *pbDenseNodes) reset() {
+	m := &d.msg
+	m.Id = m.Id[:0]
+	m.Denseinfo = nil
+	m.Lat = m.Lat[:0]
+	m.Lon = m.Lon[:0]
+	m.KeysVals = m.KeysVals[:0]
+}
+
+func (d *pbDenseNodes) unmarshal(data []byte, skipTags, skipInfo bool) error {
+	m := &d.msg
+	for len(data) > 0 {
+		f, rest, err := nextField(data)
+		if err != nil {
+			return err
+		}
+		data = rest
+
+		switch f.num {
+		case 1:
+			m.Id, err = appendVarints(m.Id, f, zigzag64)
+		case 5:
+			if f.typ != protowire.BytesType || skipInfo {
+				continue
+			}
+			if m.Denseinfo == nil {
+				di := &d.info
+				di.Version = di.Version[:0]
+				di.Timestamp = di.Timestamp[:0]
+				di.Changeset = di.Changeset[:0]
+				di.Uid = di.Uid[:0]
+				di.UserSid = di.UserSid[:0]
+				di.Visible = di.Visible[:0]
+				m.Denseinfo = di
+			}
+			err = d.unmarshalDenseInfo(f.bytes)
+		case 8:
+			m.Lat, err = appendVarints(m.Lat, f, zigzag64)
+		case 9:
+			m.Lon, err = appendVarints(m.Lon, f, zigzag64)
+		case 10:
+			if skipTags {
+				continue
+			}
+			m.KeysVals, err = appendVarints(m.KeysVals, f, varint32)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *pbDenseNodes) unmarshalDenseInfo(data []byte) error {
+	di := &d.info
+	for len(data) > 0 {
+		f, rest, err := nextField(data)
+		if err != nil {
+			return err
+		}
+		data = rest
+
+		switch f.num {
+		case 1:
+			di.Version, err = appendVarints(di.Version, f, varint32)
+		case 2:
+			di.Timestamp, err = appendVarints(di.Timestamp, f, zigzag64)
+		case 3:
+			di.Changeset, err = appendVarints(di.Changeset, f, zigzag64)
+		case 4:
+			di.Uid, err = appendVarints(di.Uid, f, zigzag32)
+		case 5:
+			di.UserSid, err = appendVarints(di.UserSid, f, zigzag32)
+		case 6:
+			di.Visible, err = appendVarints(di.Visible, f, varintBool)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *pbWay) unmarshal(data []byte, skipTags, skipInfo bool) error {
+	m := &w.msg
+	m.Id = nil
+	m.Keys = m.Keys[:0]
+	m.Vals = m.Vals[:0]
+	m.Info = nil
+	m.Refs = m.Refs[:0]
+	m.Lat = m.Lat[:0]
+	m.Lon = m.Lon[:0]
+
+	for len(data) > 0 {
+		f, rest, err := nextField(data)
+		if err != nil {
+			return err
+		}
+		data = rest
+
+		switch {
+		case f.num == 1 && f.typ == protowire.VarintType:
+			w.id = int64(f.varint)
+			m.Id = &w.id
+		case f.num == 2 && !skipTags:
+			m.Keys, err = appendVarints(m.Keys, f, varintUint32)
+		case f.num == 3 && !skipTags:
+			m.Vals, err = appendVarints(m.Vals, f, varintUint32)
+		case f.num == 4 && f.typ == protowire.BytesType && !skipInfo:
+			if m.Info == nil {
+				w.info.reset()
+				m.Info = &w.info.msg
+			}
+			err = w.info.unmarshal(f.bytes)
+		case f.num == 8:
+			m.Refs, err = appendVarints(m.Refs, f, zigzag64)
+		case f.num == 9:
+			m.Lat, err = appendVarints(m.Lat, f, zigzag64)
+		case f.num == 10:
+			m.Lon, err = appendVarints(m.Lon, f, zigzag64)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.Id == nil {
+		return requiredField("OSMPBF.Way.id")
+	}
+	return nil
+}
+
+func (r *pbRelation) unmarshal(data []byte, skipTags, skipInfo bool) error {
+	m := &r.msg
+	m.Id = nil
+	m.Keys = m.Keys[:0]
+	m.Vals = m.Vals[:0]
+	m.Info = nil
+	m.RolesSid = m.RolesSid[:0]
+	m.Memids = m.Memids[:0]
+	m.Types = m.Types[:0]
+
+	for len(data) > 0 {
+		f, rest, err := nextField(data)
+		if err != nil {
+			return err
+		}
+		data = rest
+
+		switch {
+		case f.num == 1 && f.typ == protowire.VarintType:
+			r.id = int64(f.varint)
+			m.Id = &r.id
+		case f.num == 2 && !skipTags:
+			m.Keys, err = appendVarints(m.Keys, f, varintUint32)
+		case f.num == 3 && !skipTags:
+			m.Vals, err = appendVarints(m.Vals, f, varintUint32)
+		case f.num == 4 && f.typ == protowire.BytesType && !skipInfo:
+			if m.Info == nil {
+				r.info.reset()
+				m.Info = &r.info.msg
+			}
+			err = r.info.unmarshal(f.bytes)
+		case f.num == 8:
+			m.RolesSid, err = appendVarints(m.RolesSid, f, varint32)
+		case f.num == 9:
+			m.Memids, err = appendVarints(m.Memids, f, zigzag64)
+		case f.num == 10:
+			m.Types, err = appendVarints(m.Types, f, memberType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.Id == nil {
+		return requiredField("OSMPBF.Relation.id")
+	}
+	return nil
+}
+
+func (c *pbChangeSet) unmarshal(data []byte) error {
+	c.msg.Id = nil
+	for len(data) > 0 {
+		f, rest, err := nextField(data)
+		if err != nil {
+			return err
+		}
+		data = rest
+		if f.num == 1 && f.typ == protowire.VarintType {
+			c.id = int64(f.varint)
+			c.msg.Id = &c.id
+		}
+	}
+
+	if c.msg.Id == nil {
+		return requiredField("OSMPBF.ChangeSet.id")
+	}
+	return nil
+}
+
+func (i *pbInfo) reset() {
+	m := &i.msg
+	m.Version = nil
+	m.Timestamp = nil
+	m.Changeset = nil
+	m.Uid = nil
+	m.UserSid = nil
+	m.Visible = nil
+}
+
+func (i *pbInfo) unmarshal(data []byte) error {
+	m := &i.msg
+	for len(data) > 0 {
+		f, rest, err := nextField(data)
+		if err != nil {
+			return err
+		}
+		data = rest
+		if f.typ != protowire.VarintType {
+			continue
+		}
+
+		switch f.num {
+		case 1:
+			i.version = int32(f.varint)
+			m.Version = &i.version
+		case 2:
+			i.timestamp = int64(f.varint)
+			m.Timestamp = &i.timestamp
+		case 3:
+			i.changeset = int64(f.varint)
+			m.Changeset = &i.changeset
+		case 4:
+			i.uid = int32(f.varint)
+			m.Uid = &i.uid
+		case 5:
+			i.userSid = uint32(f.varint)
+			m.UserSid = &i.userSid
+		case 6:
+			i.visible = f.varint != 0
+			m.Visible = &i.visible
+		}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package osmpbf
+
+import (
+	"testing"
+
+	"github.com/qedus/osmpbf/OSMPBF"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// Encoded PrimitiveBlocks covering all fields parsed by pbBlock.
+func unmarshalTestBlocks(t testing.TB) [][]byte {
+	info := &OSMPBF.Info{Version: proto.Int32(2), Timestamp: proto.Int64(3), Changeset: proto.Int64(4),
+		Uid: proto.Int32(5), UserSid: proto.Uint32(1), Visible: proto.Bool(false)}
+	full := &OSMPBF.PrimitiveBlock{
+		Stringtable:     &OSMPBF.StringTable{S: []string{"", "a", "b"}},
+		Granularity:     proto.Int32(1000),
+		DateGranularity: proto.Int32(1),
+		LatOffset:       proto.Int64(-7),
+		LonOffset:       proto.Int64(8),
+		Primitivegroup: []*OSMPBF.PrimitiveGroup{
+			{Nodes: []*OSMPBF.Node{
+				{Id: proto.Int64(-1), Lat: proto.Int64(2), Lon: proto.Int64(-3), Keys: []uint32{1}, Vals: []uint32{2}, Info: info},
+				{Id: proto.Int64(2), Lat: proto.Int64(0), Lon: proto.Int64(0)},
+			}},
+			{Dense: &OSMPBF.DenseNodes{
+				Id: []int64{1, 1}, Lat: []int64{-5, 6}, Lon: []int64{7, -8}, KeysVals: []int32{1, 2, 0, 0},
+				Denseinfo: &OSMPBF.DenseInfo{Version: []int32{1, 2}, Timestamp: []int64{-1, 1}, Changeset: []int64{3, -3},
+					Uid: []int32{-4, 4}, UserSid: []int32{1, -1}, Visible: []bool{true, false}},
+			}},
+			{Ways: []*OSMPBF.Way{
+				{Id: proto.Int64(10), Keys: []uint32{2}, Vals: []uint32{1}, Info: info,
+					Refs: []int64{1, -1}, Lat: []int64{1, 2}, Lon: []int64{-1, -2}},
+			}},
+			{Relations: []*OSMPBF.Relation{
+				{Id: proto.Int64(20), Info: info, RolesSid: []int32{1, 2}, Memids: []int64{5, -1},
+					Types: []OSMPBF.Relation_MemberType{OSMPBF.Relation_WAY, OSMPBF.Relation_RELATION}},
+			}},
+			{Changesets: []*OSMPBF.ChangeSet{{Id: proto.Int64(30)}}},
+		},
+	}
+	// smaller block without optional fields follows the full one to find values left over
+	sparse := &OSMPBF.PrimitiveBlock{
+		Stringtable: &OSMPBF.StringTable{S: []string{""}},
+		Primitivegroup: []*OSMPBF.PrimitiveGroup{
+			{Nodes: []*OSMPBF.Node{{Id: proto.Int64(3), Lat: proto.Int64(1), Lon: proto.Int64(1)}}},
+			{Dense: &OSMPBF.DenseNodes{Id: []int64{4}, Lat: []int64{1}, Lon: []int64{1}}},
+			{Ways: []*OSMPBF.Way{{Id: proto.Int64(11), Refs: []int64{3}}}},
+		},
+	}
+	// way with unpacked refs and unknown fields
+	var way []byte
+	way = protowire.AppendTag(way, 1, protowire.VarintType)
+	way = protowire.AppendVarint(way, 12)
+	for _, ref := range []int64{3, -1} {
+		way = protowire.AppendTag(way, 8, protowire.VarintType)
+		way = protowire.AppendVarint(way, protowire.EncodeZigZag(ref))
+	}
+	way = protowire.AppendTag(way, 15, protowire.Fixed32Type)
+	way = protowire.AppendFixed32(way, 1)
+	var pg []byte
+	pg = protowire.AppendTag(pg, 3, protowire.BytesType)
+	pg = protowire.AppendBytes(pg, way)
+	var unpacked []byte
+	unpacked = protowire.AppendTag(unpacked, 1, protowire.BytesType)
+	unpacked = protowire.AppendBytes(unpacked, nil)
+	unpacked = protowire.AppendTag(unpacked, 2, protowire.BytesType)
+	unpacked = protowire.AppendBytes(unpacked, pg)
+
+	var blocks [][]byte
+	for _, pb := range []*OSMPBF.PrimitiveBlock{full, sparse, full} {
+		data, err := proto.Marshal(pb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, data)
+	}
+	return append(blocks, unpacked)
+}
+
+func TestUnmarshalPrimitiveBlock(t *testing.T) {
+	blocks := unmarshalTestBlocks(t)
+	var b pbBlock
+	for i, data := range blocks {
+		expected := new(OSMPBF.PrimitiveBlock)
+		if err := (proto.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(data, expected); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.unmarshal(data); err != nil {
+			t.Fatalf("block %d: %v", i, err)
+		}
+		if !proto.Equal(expected, &b.msg) {
+			t.Errorf("block %d:\nExpected: %v\nActual:   %v", i, expected, &b.msg)
+		}
+	}
+
+	// invalid blocks
+	pb := group(&OSMPBF.PrimitiveGroup{Nodes: []*OSMPBF.Node{{Id: proto.Int64(1), Lat: proto.Int64(1)}}})
+	pb.Stringtable = &OSMPBF.StringTable{}
+	node, err := proto.MarshalOptions{AllowPartial: true}.Marshal(pb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{
+		"truncated":   blocks[0][:len(blocks[0])-1],
+		"node lon":    node,
+		"stringtable": {},
+	} {
+		if err := proto.Unmarshal(data, new(OSMPBF.PrimitiveBlock)); err == nil {
+			t.Fatalf("%s: proto.Unmarshal accepted invalid block", name)
+		}
+		if err := b.unmarshal(data); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+// Compare pbBlock with proto.Unmarshal on arbitrary input. Every input is parsed twice by
+// the same pbBlock, after a different block, to find values left over from previous blocks.
+func FuzzUnmarshal(f *testing.F) {
+	blocks := unmarshalTestBlocks(f)
+	for _, data := range blocks {
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		expected := new(OSMPBF.PrimitiveBlock)
+		expectedErr := (proto.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(data, expected)
+
+		var b pbBlock
+		for _, previous := range [][]byte{nil, blocks[0]} {
+			if previous != nil {
+				if err := b.unmarshal(previous); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := b.unmarshal(data)
+			if (err == nil) != (expectedErr == nil) {
+				t.Fatalf("expected error %v, got %v", expectedErr, err)
+			}
+			if err == nil && !proto.Equal(expected, &b.msg) {
+				t.Fatalf("\nExpected: %v\nActual:   %v", expected, &b.msg)
+			}
+		}
+	})
+}
+
+func TestUnmarshalSkip(t *testing.T) {
+	full := unmarshalTestBlocks(t)[0]
+
+	var b pbBlock
+	b.skip = pbSkip{tags: true, info: true, nodeTags: true, nodeInfo: true}
+	if err := b.unmarshal(full); err != nil {
+		t.Fatal(err)
+	}
+	for _, pg := range b.msg.Primitivegroup {
+		for _, n := range pg.Nodes {
+			if n.Info != nil || len(n.Keys) > 0 || len(n.Vals) > 0 {
+				t.Errorf("unexpected node info or tags: %v", n)
+			}
+		}
+		if dn := pg.Dense; dn != nil && (dn.Denseinfo != nil || len(dn.KeysVals) > 0 || len(dn.Id) != 2) {
+			t.Errorf("unexpected dense nodes: %v", dn)
+		}
+		for _, w := range pg.Ways {
+			if w.Info != nil || len(w.Keys) > 0 || len(w.Vals) > 0 || len(w.Refs) != 2 {
+				t.Errorf("unexpected way: %v", w)
+			}
+		}
+		for _, r := range pg.Relations {
+			if r.Info != nil || len(r.Memids) != 2 {
+				t.Errorf("unexpected relation: %v", r)
+			}
+		}
+	}
+
+	b.skip = pbSkip{nodes: true, ways: true, relations: true, changesets: true}
+	if err := b.unmarshal(full); err != nil {
+		t.Fatal(err)
+	}
+	for _, pg := range b.msg.Primitivegroup {
+		if len(pg.Nodes) > 0 || pg.Dense != nil || len(pg.Ways) > 0 || len(pg.Relations) > 0 || len(pg.Changesets) > 0 {
+			t.Errorf("unexpected objects: %v", pg)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package osmpbf
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Elements and attributes of OSM XML format version 0.6.
+// The same types are used by XMLEncoder.
+
+type xmlTag struct {
+	K string `xml:"k,attr"`
+	V string `xml:"v,attr"`
+}
+
+type xmlInfo struct {
+	Version   int32  `xml:"version,attr,omitempty"`
+	Timestamp string `xml:"timestamp,attr,omitempty"`
+	Changeset int64  `xml:"changeset,attr,omitempty"`
+	Uid       int32  `xml:"uid,attr,omitempty"`
+	User      string `xml:"user,attr,omitempty"`
+	Visible   string `xml:"visible,attr,omitempty"`
+}
+
+// Coordinate in degrees, written without exponent.
+type xmlCoordinate float64
+
+// Nil coordinate is omitted.
+func (c *xmlCoordinate) MarshalXMLAttr(name xml.Name) (xml.Attr, error) {
+	if c == nil {
+		return xml.Attr{}, nil
+	}
+	s := strconv.FormatFloat(float64(*c), 'f', 7, 64)
+	s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	return xml.Attr{Name: name, Value: s}, nil
+}
+
+func (c *xmlCoordinate) UnmarshalXMLAttr(attr xml.Attr) error {
+	f, err := strconv.ParseFloat(attr.Value, 64)
+	*c = xmlCoordinate(f)
+	return err
+}
+
+type xmlNode struct {
+	XMLName xml.Name      `xml:"node"`
+	ID      int64         `xml:"id,attr"`
+	Lat     xmlCoordinate `xml:"lat,attr"`
+	Lon     xmlCoordinate `xml:"lon,attr"`
+	xmlInfo
+	Tags []xmlTag `xml:"tag"`
+}
+
+type xmlNd struct {
+	Ref int64 `xml:"ref,attr"`
+
+	// not in OSM schema, but written by Overpass API with "out geom"
+	Lat *xmlCoordinate `xml:"lat,attr,omitempty"`
+	Lon *xmlCoordinate `xml:"lon,attr,omitempty"`
+}
+
+type xmlWay struct {
+	XMLName xml.Name `xml:"way"`
+	ID      int64    `xml:"id,attr"`
+	xmlInfo
+	Nds  []xmlNd  `xml:"nd"`
+	Tags []xmlTag `xml:"tag"`
+}
+
+type xmlMember struct {
+	Type string `xml:"type,attr"`
+	Ref  int64  `xml:"ref,attr"`
+	Role string `xml:"role,attr"`
+}
+
+type xmlRelation struct {
+	XMLName xml.Name `xml:"relation"`
+	ID      int64    `xml:"id,attr"`
+	xmlInfo
+	Members []xmlMember `xml:"member"`
+	Tags    []xmlTag    `xml:"tag"`
+}
+
+type xmlChangeset struct {
+	XMLName xml.Name `xml:"changeset"`
+	ID      int64    `xml:"id,attr"`
+}
+
+type xmlBounds struct {
+	XMLName xml.Name `xml:"bounds"`
+
+	MinLat xmlCoordinate `xml:"minlat,attr"`
+	MinLon xmlCoordinate `xml:"minlon,attr"`
+	MaxLat xmlCoordinate `xml:"maxlat,attr"`
+	MaxLon xmlCoordinate `xml:"maxlon,attr"`
+}
+
+var xmlMemberTypes = map[string]MemberType{
+	"node":     NodeType,
+	"way":      WayType,
+	"relation": RelationType,
+}
+
+// An XMLDecoder reads OpenStreetMap XML data (.osm files) from an input stream.
+// It returns the same types as Decoder.
+type XMLDecoder struct {
+	d *xml.Decoder
+
+	header *Header
+
+	// start of the first object element read while reading header
+	next *xml.StartElement
+
+	// first error encountered, returned by all subsequent calls
+	err error
+}
+
+// NewXMLDecoder returns a new decoder that reads from r.
+func NewXMLDecoder(r io.Reader) *XMLDecoder {
+	return &XMLDecoder{d: xml.NewDecoder(r)}
+}
+
+// Header returns file header built from the root element and <bounds> element.
+func (dec *XMLDecoder) Header() (*Header, error) {
+	if dec.header == nil && dec.err == nil {
+		dec.err = dec.readHeader()
+	}
+	return dec.header, dec.err
+}
+
+func (dec *XMLDecoder) readHeader() error {
+	header := &Header{RequiredFeatures: []string{"OsmSchema-V0.6"}}
+	for {
+		t, err := dec.d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch se.Name.Local {
+		case "osm":
+			for _, a := range se.Attr {
+				switch a.Name.Local {
+				case "version":
+					if a.Value != "0.6" {
+						return fmt.Errorf("unsupported OSM XML version %q", a.Value)
+					}
+				case "generator":
+					header.WritingProgram = a.Value
+				}
+			}
+		case "bounds":
+			var b xmlBounds
+			if err = dec.d.DecodeElement(&b, &se); err != nil {
+				return err
+			}
+			header.BoundingBox = &BoundingBox{
+				Left:   float64(b.MinLon),
+				Right:  float64(b.MaxLon),
+				Top:    float64(b.MaxLat),
+				Bottom: float64(b.MinLat),
+			}
+		case "bound":
+			// written by osmosis as box="minlat,minlon,maxlat,maxlon"
+			for _, a := range se.Attr {
+				if a.Name.Local == "box" {
+					if header.BoundingBox, err = parseXMLBox(a.Value); err != nil {
+						return err
+					}
+				}
+			}
+		case "node", "way", "relation", "changeset":
+			dec.next = &se
+			dec.header = header
+			return nil
+		}
+	}
+	dec.header = header
+	return nil
+}
+
+func parseXMLBox(s string) (*BoundingBox, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("invalid bound box %q", s)
+	}
+	var v [4]float64
+	for index, part := range parts {
+		var err error
+		if v[index], err = strconv.ParseFloat(part, 64); err != nil {
+			return nil, err
+		}
+	}
+	return &BoundingBox{Left: v[1], Right: v[3], Top: v[2], Bottom: v[0]}, nil
+}
+
+// Decode reads the next object and returns either a pointer to Node, Way, Relation or
+// Changeset struct or one of these errors: io.EOF at the end of the stream, or an error
+// for invalid input.
+func (dec *XMLDecoder) Decode() (interface{}, error) {
+	if _, err := dec.Header(); err != nil {
+		return nil, err
+	}
+
+	for {
+		se := dec.next
+		dec.next = nil
+		if se == nil {
+			t, err := dec.d.Token()
+			if err != nil {
+				if err != io.EOF {
+					dec.err = err
+				}
+				return nil, err
+			}
+			if s, ok := t.(xml.StartElement); ok {
+				se = &s
+			} else {
+				continue
+			}
+		}
+
+		o, err := dec.decodeElement(se)
+		if err != nil {
+			dec.err = err
+			return nil, err
+		}
+		if o != nil {
+			return o, nil
+		}
+	}
+}
+
+// Decode object element, returns nil for other elements.
+func (dec *XMLDecoder) decodeElement(se *xml.StartElement) (interface{}, error) {
+	switch se.Name.Local {
+	case "node":
+		var n xmlNode
+		if err := dec.d.DecodeElement(&n, se); err != nil {
+			return nil, err
+		}
+		info, err := n.info()
+		if err != nil {
+			return nil, err
+		}
+		return &Node{n.ID, float64(n.Lat), float64(n.Lon), xmlTags(n.Tags), info, nil}, nil
+
+	case "way":
+		var w xmlWay
+		if err := dec.d.DecodeElement(&w, se); err != nil {
+			return nil, err
+		}
+		info, err := w.info()
+		if err != nil {
+			return nil, err
+		}
+		nodeIDs := make([]int64, len(w.Nds))
+		locations := make([]Location, len(w.Nds))
+		for index, nd := range w.Nds {
+			nodeIDs[index] = nd.Ref
+			if nd.Lat == nil || nd.Lon == nil {
+				locations = nil
+			} else if locations != nil {
+				locations[index] = Location{float64(*nd.Lat), float64(*nd.Lon)}
+			}
+		}
+		if len(locations) == 0 {
+			locations = nil
+		}
+		return &Way{w.ID, xmlTags(w.Tags), nodeIDs, info, locations, nil}, nil
+
+	case "relation":
+		var r xmlRelation
+		if err := dec.d.DecodeElement(&r, se); err != nil {
+			return nil, err
+		}
+		info, err := r.info()
+		if err != nil {
+			return nil, err
+		}
+		members := make([]Member, len(r.Members))
+		for index, m := range r.Members {
+			t, ok := xmlMemberTypes[m.Type]
+			if !ok {
+				return nil, fmt.Errorf("relation %d: unknown member type %q", r.ID, m.Type)
+			}
+			members[index] = Member{m.Ref, t, m.Role}
+		}
+		return &Relation{r.ID, xmlTags(r.Tags), members, info, nil}, nil
+
+	case "changeset":
+		var c xmlChangeset
+		if err := dec.d.DecodeElement(&c, se); err != nil {
+			return nil, err
+		}
+		return &Changeset{c.ID}, nil
+	}
+	return nil, nil
+}
+
+func xmlTags(xt []xmlTag) map[string]string {
+	tags := make(map[string]string, len(xt))
+	for _, t := range xt {
+		tags[t.K] = t.V
+	}
+	return tags
+}
+
+func (xi *xmlInfo) info() (Info, error) {
+	info := Info{
+		Version:   xi.Version,
+		Changeset: xi.Changeset,
+		Uid:       xi.Uid,
+		User:      xi.User,
+		Visible:   xi.Visible != "false",
+	}
+	if xi.Timestamp != "" {
+		t, err := time.Parse(time.RFC3339, xi.Timestamp)
+		if err != nil {
+			return info, err
+		}
+		info.Timestamp = t.UTC()
+	}
+	return info, nil
+}
@@ -0,0 +1,110 @@
+package osmpbf
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testXML = `<?xml version="1.0" encoding="UTF-8"?>
+<osm version="0.6" generator="osmpbf-test">
+ <bounds minlat="51.28554" minlon="-0.511482" maxlat="51.69344" maxlon="0.335437"/>
+ <node id="1" lat="51.5" lon="-0.125" version="2" timestamp="2014-03-24T21:55:02Z" changeset="10" uid="5" user="a">
+  <tag k="amenity" v="pub"/>
+ </node>
+ <node id="2" lat="-33.75" lon="151.5" version="3" visible="false"/>
+ <way id="3" version="1" timestamp="2010-01-02T03:04:05Z" changeset="1" uid="1" user="b">
+  <nd ref="1"/>
+  <nd ref="2"/>
+  <tag k="highway" v="primary"/>
+ </way>
+ <way id="4">
+  <nd ref="1" lat="51.5" lon="-0.125"/>
+  <nd ref="2" lat="-33.75" lon="151.5"/>
+ </way>
+ <relation id="5" version="1">
+  <member type="way" ref="3" role="outer"/>
+  <member type="node" ref="1" role=""/>
+  <tag k="type" v="multipolygon"/>
+ </relation>
+</osm>
+`
+
+func TestXMLDecoder(t *testing.T) {
+	d := NewXMLDecoder(strings.NewReader(testXML))
+	header, err := d.Header()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedHeader := &Header{
+		BoundingBox:      &BoundingBox{Left: -0.511482, Right: 0.335437, Top: 51.69344, Bottom: 51.28554},
+		RequiredFeatures: []string{"OsmSchema-V0.6"},
+		WritingProgram:   "osmpbf-test",
+	}
+	if !reflect.DeepEqual(expectedHeader, header) {
+		t.Errorf("\nExpected: %#v\nActual:   %#v", expectedHeader, header)
+	}
+
+	expected := []interface{}{
+		&Node{ID: 1, Lat: 51.5, Lon: -0.125, Tags: map[string]string{"amenity": "pub"}, Info: Info{
+			Version: 2, Timestamp: parseTime("2014-03-24T21:55:02Z"), Changeset: 10, Uid: 5, User: "a", Visible: true,
+		}},
+		&Node{ID: 2, Lat: -33.75, Lon: 151.5, Tags: map[string]string{}, Info: Info{Version: 3}},
+		&Way{ID: 3, Tags: map[string]string{"highway": "primary"}, NodeIDs: []int64{1, 2}, Info: Info{
+			Version: 1, Timestamp: parseTime("2010-01-02T03:04:05Z"), Changeset: 1, Uid: 1, User: "b", Visible: true,
+		}},
+		&Way{ID: 4, Tags: map[string]string{}, NodeIDs: []int64{1, 2}, Info: Info{Visible: true},
+			Locations: []Location{{51.5, -0.125}, {-33.75, 151.5}}},
+		&Relation{ID: 5, Tags: map[string]string{"type": "multipolygon"}, Members: []Member{
+			{3, WayType, "outer"}, {1, NodeType, ""},
+		}, Info: Info{Version: 1, Visible: true}},
+	}
+	var actual []interface{}
+	for {
+		o, err := d.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual = append(actual, o)
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("\nExpected: %#v\nActual:   %#v", expected, actual)
+	}
+}
+
+func TestXMLDecoderErrors(t *testing.T) {
+	for _, s := range []string{
+		`<osm version="0.5"></osm>`,
+		`<osm version="0.6"><node id="1" timestamp="yesterday"/></osm>`,
+		`<osm version="0.6"><relation id="1"><member type="area" ref="1"/></relation></osm>`,
+		`<osm version="0.6"><node id="x"/></osm>`,
+		`<osm version="0.6"><node id="1">`,
+	} {
+		d := NewXMLDecoder(strings.NewReader(s))
+		var err error
+		for err == nil {
+			_, err = d.Decode()
+		}
+		if err == io.EOF {
+			t.Errorf("%s: expected error", s)
+		}
+	}
+}
+
+func TestXMLDecoderBound(t *testing.T) {
+	d := NewXMLDecoder(strings.NewReader(`<osm version="0.6"><bound box="-1,-2,3,4" origin="osmosis"/></osm>`))
+	header, err := d.Header()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(header.BoundingBox, &BoundingBox{Left: -2, Right: 4, Top: 3, Bottom: -1}) {
+		t.Errorf("unexpected bounding box %v", header.BoundingBox)
+	}
+	if _, err = d.Decode(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
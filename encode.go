@@ -0,0 +1,254 @@
+package osmpbf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+
+	"github.com/qedus/osmpbf/OSMPBF"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// typical PrimitiveBlock contains 8k OSM entities
+	maxBlockEntities = 8000
+
+	// PrimitiveBlock is written early when estimated size of its objects exceeds this,
+	// leaving room for fields outside of objects
+	maxBlockRawSize = MaxBlobSize - 64*1024
+
+	writingProgram = "github.com/qedus/osmpbf"
+)
+
+var (
+	defaultRequiredFeatures = []string{"OsmSchema-V0.6", "DenseNodes"}
+
+	errEncoderClosed = errors.New("encoder is closed")
+)
+
+// An Encoder writes OpenStreetMap PBF data to an output stream.
+type Encoder struct {
+	w      io.Writer
+	header *Header
+
+	// first error encountered, returned by all subsequent calls
+	err           error
+	headerWritten bool
+
+	// header has "HistoricalInformation" required feature
+	history bool
+
+	// entities of a single type encoded into PrimitiveBlock waiting to be written,
+	// their number and upper bound of encoded size
+	pending      *blockEncoder
+	pendingKind  int
+	pendingCount int
+	pendingSize  int
+}
+
+// NewEncoder returns a new encoder that writes to w. The OSMHeader fileblock
+// built from header is written before the first object. If header is nil,
+// a header with default required features is used. Required features
+// "OsmSchema-V0.6" and "DenseNodes" are written even if header misses them,
+// since nodes are always written as DenseNodes.
+func NewEncoder(w io.Writer, header *Header) *Encoder {
+	if header == nil {
+		header = new(Header)
+	}
+	return &Encoder{
+		w:      w,
+		header: header,
+	}
+}
+
+// Encode writes a pointer to Node, Way, Relation or Changeset struct to the output stream.
+// Objects are encoded into blocks of the same type, so the order of objects is
+// preserved, and v is not used after Encode returns. Close must be called to write
+// the last block.
+//
+// Way locations are written if they are present for all nodes of the way;
+// add "LocationsOnWays" to Header.OptionalFeatures in that case.
+// Info.Visible is written only if Header.RequiredFeatures has "HistoricalInformation".
+func (enc *Encoder) Encode(v interface{}) error {
+	if enc.err != nil {
+		return enc.err
+	}
+
+	kind, _, ok := objectKindID(v)
+	if !ok {
+		return fmt.Errorf("unsupported type %T", v)
+	}
+
+	if err := enc.writeOSMHeader(); err != nil {
+		return err
+	}
+
+	size := encodedSizeBound(v)
+	if enc.pending != nil && (kind != enc.pendingKind || enc.pendingCount >= maxBlockEntities ||
+		enc.pendingSize+size > maxBlockRawSize) {
+		if err := enc.flush(); err != nil {
+			return err
+		}
+	}
+
+	if enc.pending == nil {
+		enc.pending = newBlockEncoder(enc.history)
+		enc.pendingKind = kind
+	}
+	enc.pending.encode(v)
+	enc.pendingCount++
+	enc.pendingSize += size
+	return nil
+}
+
+// Close writes any buffered objects to the output stream. It does not close
+// the underlying writer.
+func (enc *Encoder) Close() error {
+	if enc.err != nil {
+		return enc.err
+	}
+
+	if err := enc.writeOSMHeader(); err != nil {
+		return err
+	}
+	if err := enc.flush(); err != nil {
+		return err
+	}
+
+	enc.err = errEncoderClosed
+	return nil
+}
+
+func (enc *Encoder) flush() error {
+	if enc.pending == nil {
+		return nil
+	}
+
+	be := enc.pending
+	enc.pending, enc.pendingCount, enc.pendingSize = nil, 0, 0
+	return enc.writeFileBlock("OSMData", be.primitiveBlock())
+}
+
+func (enc *Encoder) writeOSMHeader() error {
+	if enc.headerWritten {
+		return nil
+	}
+	enc.headerWritten = true
+
+	h := enc.header
+	headerBlock := &OSMPBF.HeaderBlock{
+		RequiredFeatures: requiredFeatures(h.RequiredFeatures),
+		OptionalFeatures: h.OptionalFeatures,
+		Writingprogram:   proto.String(h.WritingProgram),
+	}
+	for _, feature := range headerBlock.RequiredFeatures {
+		if feature == "HistoricalInformation" {
+			enc.history = true
+		}
+	}
+	if h.WritingProgram == "" {
+		headerBlock.Writingprogram = proto.String(writingProgram)
+	}
+	if h.Source != "" {
+		headerBlock.Source = proto.String(h.Source)
+	}
+	if !h.OsmosisReplicationTimestamp.IsZero() {
+		headerBlock.OsmosisReplicationTimestamp = proto.Int64(h.OsmosisReplicationTimestamp.Unix())
+	}
+	if h.OsmosisReplicationSequenceNumber != 0 {
+		headerBlock.OsmosisReplicationSequenceNumber = proto.Int64(h.OsmosisReplicationSequenceNumber)
+	}
+	if h.OsmosisReplicationBaseUrl != "" {
+		headerBlock.OsmosisReplicationBaseUrl = proto.String(h.OsmosisReplicationBaseUrl)
+	}
+	if h.BoundingBox != nil {
+		// Units are always in nanodegree and do not obey granularity rules. See osmformat.proto
+		headerBlock.Bbox = &OSMPBF.HeaderBBox{
+			Left:   proto.Int64(int64(math.Round(1e9 * h.BoundingBox.Left))),
+			Right:  proto.Int64(int64(math.Round(1e9 * h.BoundingBox.Right))),
+			Top:    proto.Int64(int64(math.Round(1e9 * h.BoundingBox.Top))),
+			Bottom: proto.Int64(int64(math.Round(1e9 * h.BoundingBox.Bottom))),
+		}
+	}
+
+	return enc.writeFileBlock("OSMHeader", headerBlock)
+}
+
+// Return default required features followed by other features of header.
+func requiredFeatures(features []string) []string {
+	required := slices.Clone(defaultRequiredFeatures)
+	for _, feature := range features {
+		if !slices.Contains(required, feature) {
+			required = append(required, feature)
+		}
+	}
+	return required
+}
+
+func (enc *Encoder) writeFileBlock(blobType string, m proto.Message) error {
+	blob, err := encodeBlob(m)
+	if err != nil {
+		enc.err = err
+		return err
+	}
+
+	blobData, err := proto.Marshal(blob)
+	if err != nil {
+		enc.err = err
+		return err
+	}
+	if len(blobData) >= MaxBlobSize {
+		enc.err = errors.New("Blob size >= 32Mb")
+		return enc.err
+	}
+
+	blobHeader := &OSMPBF.BlobHeader{
+		Type:     proto.String(blobType),
+		Datasize: proto.Int32(int32(len(blobData))),
+	}
+	blobHeaderData, err := proto.Marshal(blobHeader)
+	if err != nil {
+		enc.err = err
+		return err
+	}
+
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(blobHeaderData)))
+	for _, b := range [][]byte{size[:], blobHeaderData, blobData} {
+		if _, err := enc.w.Write(b); err != nil {
+			enc.err = err
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeBlob(m proto.Message) (*OSMPBF.Blob, error) {
+	data, err := proto.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxBlobSize {
+		return nil, errors.New("raw Blob size > 32Mb")
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(data)/2))
+	w := zlib.NewWriter(buf)
+	if _, err = w.Write(data); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+
+	blob := &OSMPBF.Blob{
+		RawSize: proto.Int32(int32(len(data))),
+		Data:    &OSMPBF.Blob_ZlibData{ZlibData: buf.Bytes()},
+	}
+	return blob, nil
+}
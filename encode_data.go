@@ -0,0 +1,298 @@
+package osmpbf
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/qedus/osmpbf/OSMPBF"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// coordinates are written with default granularity of 100 nanodegrees
+	granularity = 100
+
+	// timestamps are written with default granularity of 1000 milliseconds
+	dateGranularity = 1000
+)
+
+// Encoder for PrimitiveBlock with OSMData
+type blockEncoder struct {
+	st stringTable
+	pg *OSMPBF.PrimitiveGroup
+
+	// write visible flags for "HistoricalInformation" required feature
+	history bool
+
+	// previous dense node for delta encoding
+	denseState denseNodeState
+}
+
+func newBlockEncoder(history bool) *blockEncoder {
+	return &blockEncoder{
+		st:      stringTable{index: map[string]uint32{"": 0}, s: []string{""}},
+		pg:      new(OSMPBF.PrimitiveGroup),
+		history: history,
+	}
+}
+
+func (enc *blockEncoder) primitiveBlock() *OSMPBF.PrimitiveBlock {
+	return &OSMPBF.PrimitiveBlock{
+		Stringtable:    &OSMPBF.StringTable{S: enc.st.s},
+		Primitivegroup: []*OSMPBF.PrimitiveGroup{enc.pg},
+	}
+}
+
+// Encode object into the PrimitiveGroup; all objects of a block have the same type.
+func (enc *blockEncoder) encode(o interface{}) {
+	switch o := o.(type) {
+	case *Node:
+		enc.encodeNode(o)
+	case *Way:
+		enc.encodeWay(o)
+	case *Relation:
+		enc.encodeRelation(o)
+	case *Changeset:
+		enc.pg.Changesets = append(enc.pg.Changesets, &OSMPBF.ChangeSet{Id: proto.Int64(o.ID)})
+	}
+}
+
+func (enc *blockEncoder) encodeNode(n *Node) {
+	dn := enc.pg.Dense
+	if dn == nil {
+		dn = &OSMPBF.DenseNodes{Denseinfo: new(OSMPBF.DenseInfo)}
+		enc.pg.Dense = dn
+	}
+
+	prev := enc.denseState
+	lat := encodeCoordinate(n.Lat)
+	lon := encodeCoordinate(n.Lon)
+	dn.Id = append(dn.Id, n.ID-prev.id)
+	dn.Lat = append(dn.Lat, lat-prev.lat)
+	dn.Lon = append(dn.Lon, lon-prev.lon)
+
+	for _, tag := range tagList(n.Tags, n.TagList) {
+		dn.KeysVals = append(dn.KeysVals, int32(enc.st.id(tag.Key)), int32(enc.st.id(tag.Value)))
+	}
+	dn.KeysVals = append(dn.KeysVals, 0)
+
+	di := dn.Denseinfo
+	timestamp := encodeTimestamp(n.Info.Timestamp)
+	userSid := int32(enc.st.id(n.Info.User))
+	di.Version = append(di.Version, n.Info.Version)
+	di.Timestamp = append(di.Timestamp, timestamp-prev.timestamp)
+	di.Changeset = append(di.Changeset, n.Info.Changeset-prev.changeset)
+	di.Uid = append(di.Uid, n.Info.Uid-prev.uid)
+	di.UserSid = append(di.UserSid, userSid-prev.userSid)
+	if enc.history {
+		di.Visible = append(di.Visible, n.Info.Visible)
+	}
+
+	enc.denseState = denseNodeState{
+		id:  n.ID,
+		lat: lat,
+		lon: lon,
+		denseInfoState: denseInfoState{
+			timestamp: timestamp,
+			changeset: n.Info.Changeset,
+			uid:       n.Info.Uid,
+			userSid:   userSid,
+		},
+	}
+}
+
+func (enc *blockEncoder) encodeWay(w *Way) {
+	keys, vals := enc.tags(w.Tags, w.TagList)
+
+	var prev int64
+	refs := make([]int64, len(w.NodeIDs))
+	for index, nodeID := range w.NodeIDs {
+		refs[index] = nodeID - prev // delta encoding
+		prev = nodeID
+	}
+
+	way := &OSMPBF.Way{
+		Id:   proto.Int64(w.ID),
+		Keys: keys,
+		Vals: vals,
+		Info: enc.info(&w.Info),
+		Refs: refs,
+	}
+
+	// LocationsOnWays optional feature
+	if len(w.NodeIDs) > 0 && len(w.Locations) == len(w.NodeIDs) {
+		var prevLat, prevLon int64
+		way.Lat = make([]int64, len(w.Locations))
+		way.Lon = make([]int64, len(w.Locations))
+		for index, loc := range w.Locations {
+			lat := encodeCoordinate(loc.Lat)
+			lon := encodeCoordinate(loc.Lon)
+			way.Lat[index] = lat - prevLat // delta encoding
+			way.Lon[index] = lon - prevLon // delta encoding
+			prevLat, prevLon = lat, lon
+		}
+	}
+
+	enc.pg.Ways = append(enc.pg.Ways, way)
+}
+
+func (enc *blockEncoder) encodeRelation(r *Relation) {
+	keys, vals := enc.tags(r.Tags, r.TagList)
+
+	var prev int64
+	memIDs := make([]int64, len(r.Members))
+	types := make([]OSMPBF.Relation_MemberType, len(r.Members))
+	roleIDs := make([]int32, len(r.Members))
+	for index, m := range r.Members {
+		memIDs[index] = m.ID - prev // delta encoding
+		prev = m.ID
+
+		switch m.Type {
+		case NodeType:
+			types[index] = OSMPBF.Relation_NODE
+		case WayType:
+			types[index] = OSMPBF.Relation_WAY
+		case RelationType:
+			types[index] = OSMPBF.Relation_RELATION
+		}
+
+		roleIDs[index] = int32(enc.st.id(m.Role))
+	}
+
+	enc.pg.Relations = append(enc.pg.Relations, &OSMPBF.Relation{
+		Id:       proto.Int64(r.ID),
+		Keys:     keys,
+		Vals:     vals,
+		Info:     enc.info(&r.Info),
+		RolesSid: roleIDs,
+		Memids:   memIDs,
+		Types:    types,
+	})
+}
+
+// Make two parallel arrays of string IDs from tags map or tag list, see tagList.
+func (enc *blockEncoder) tags(tags map[string]string, list []Tag) (keys, vals []uint32) {
+	list = tagList(tags, list)
+	if len(list) == 0 {
+		return nil, nil
+	}
+
+	keys = make([]uint32, 0, len(list))
+	vals = make([]uint32, 0, len(list))
+	for _, tag := range list {
+		keys = append(keys, enc.st.id(tag.Key))
+		vals = append(vals, enc.st.id(tag.Value))
+	}
+	return keys, vals
+}
+
+func (enc *blockEncoder) info(info *Info) *OSMPBF.Info {
+	i := &OSMPBF.Info{
+		Version:   proto.Int32(info.Version),
+		Timestamp: proto.Int64(encodeTimestamp(info.Timestamp)),
+		Changeset: proto.Int64(info.Changeset),
+		Uid:       proto.Int32(info.Uid),
+		UserSid:   proto.Uint32(enc.st.id(info.User)),
+	}
+	if enc.history {
+		i.Visible = proto.Bool(info.Visible)
+	}
+	return i
+}
+
+type denseNodeState struct {
+	id  int64
+	lat int64
+	lon int64
+	denseInfoState
+}
+
+// Stringtable being built for a PrimitiveBlock. Index 0 is reserved as delimiter.
+type stringTable struct {
+	index map[string]uint32
+	s     []string
+}
+
+func (st *stringTable) id(s string) uint32 {
+	if id, ok := st.index[s]; ok {
+		return id
+	}
+	id := uint32(len(st.s))
+	st.index[s] = id
+	st.s = append(st.s, s)
+	return id
+}
+
+// Upper bound of bytes an object adds to encoded PrimitiveBlock, counting its strings
+// as if all of them were new entries of stringtable.
+func encodedSizeBound(v interface{}) int {
+	const (
+		varint = binary.MaxVarintLen64
+		// entity fields other than repeated ones, including Info, tags and length prefixes
+		entity = 32 * varint
+		// stringtable entry without the string, and its key or value ID
+		str = 1 + 2*binary.MaxVarintLen32
+	)
+
+	size := entity
+	var tags map[string]string
+	var list []Tag
+	var user string
+	switch v := v.(type) {
+	case *Node:
+		tags, list, user = v.Tags, v.TagList, v.Info.User
+	case *Way:
+		tags, list, user = v.Tags, v.TagList, v.Info.User
+		size += 3 * varint * len(v.NodeIDs) // refs and locations
+	case *Relation:
+		tags, list, user = v.Tags, v.TagList, v.Info.User
+		for _, m := range v.Members {
+			size += 2*varint + str + len(m.Role)
+		}
+	}
+	size += str + len(user)
+	if len(tags) > 0 {
+		for key, value := range tags {
+			size += 2*str + len(key) + len(value)
+		}
+	} else {
+		for _, tag := range list {
+			size += 2*str + len(tag.Key) + len(tag.Value)
+		}
+	}
+	return size
+}
+
+// Return tags map as tag list sorted by key, or tag list of ReuseObjects mode if map is empty.
+func tagList(tags map[string]string, list []Tag) []Tag {
+	if len(tags) == 0 {
+		return list
+	}
+	list = make([]Tag, 0, len(tags))
+	for _, key := range sortedKeys(tags) {
+		list = append(list, Tag{key, tags[key]})
+	}
+	return list
+}
+
+func sortedKeys(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func encodeCoordinate(degrees float64) int64 {
+	return int64(math.Round(1e9 * degrees / granularity))
+}
+
+func encodeTimestamp(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix() * 1000 / dateGranularity
+}
@@ -0,0 +1,205 @@
+package osmpbf
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	encodeHeader = &Header{
+		BoundingBox: &BoundingBox{
+			Left:   -0.511482,
+			Right:  0.335437,
+			Top:    51.69344,
+			Bottom: 51.28554,
+		},
+		RequiredFeatures:                 []string{"OsmSchema-V0.6", "DenseNodes"},
+		OptionalFeatures:                 []string{"Sort.Type_then_ID"},
+		WritingProgram:                   "osmpbf-test",
+		Source:                           "test",
+		OsmosisReplicationTimestamp:      time.Date(2014, 3, 24, 21, 55, 2, 0, time.UTC),
+		OsmosisReplicationSequenceNumber: 42,
+		OsmosisReplicationBaseUrl:        "https://example.com/replication",
+	}
+
+	encodeObjects = []interface{}{
+		en,
+		&Node{
+			ID:   18088579,
+			Lat:  -33.8688197,
+			Lon:  151.2092955,
+			Tags: map[string]string{},
+			Info: Info{
+				Version:   1,
+				Timestamp: parseTime("2010-01-02T03:04:05Z"),
+				Changeset: 1,
+				Uid:       1,
+				User:      "a",
+				Visible:   true,
+			},
+		},
+		ew,
+		er,
+	}
+)
+
+func bboxAlmostEqual(a, b *BoundingBox) bool {
+	const eps = 1e-9
+	return math.Abs(a.Left-b.Left) < eps && math.Abs(a.Right-b.Right) < eps &&
+		math.Abs(a.Top-b.Top) < eps && math.Abs(a.Bottom-b.Bottom) < eps
+}
+
+// encodePBF writes header and objects to a new PBF stream.
+func encodePBF(t testing.TB, header *Header, objects []interface{}) []byte {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf, header)
+	for _, o := range objects {
+		if err := e.Encode(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// decodeAll reads all objects from the PBF stream.
+func decodeAll(t testing.TB, d *Decoder) []interface{} {
+	if err := d.Start(2); err != nil {
+		t.Fatal(err)
+	}
+
+	var objects []interface{}
+	for {
+		v, err := d.Decode()
+		if err == io.EOF {
+			return objects
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		objects = append(objects, v)
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	d := NewDecoder(bytes.NewReader(encodePBF(t, encodeHeader, encodeObjects)))
+
+	header, err := d.Header()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !header.OsmosisReplicationTimestamp.Equal(encodeHeader.OsmosisReplicationTimestamp) {
+		t.Errorf("\nExpected: %v\nActual:   %v", encodeHeader.OsmosisReplicationTimestamp, header.OsmosisReplicationTimestamp)
+	}
+	header.OsmosisReplicationTimestamp = encodeHeader.OsmosisReplicationTimestamp
+	if !bboxAlmostEqual(encodeHeader.BoundingBox, header.BoundingBox) {
+		t.Errorf("\nExpected: %#v\nActual:   %#v", encodeHeader.BoundingBox, header.BoundingBox)
+	}
+	header.BoundingBox = encodeHeader.BoundingBox
+	if !reflect.DeepEqual(encodeHeader, header) {
+		t.Errorf("\nExpected: %#v\nActual:   %#v", encodeHeader, header)
+	}
+
+	objects := decodeAll(t, d)
+	if !reflect.DeepEqual(encodeObjects, objects) {
+		t.Errorf("\nExpected: %#v\nActual:   %#v", encodeObjects, objects)
+	}
+}
+
+func TestEncodeManyBlocks(t *testing.T) {
+	var objects []interface{}
+	for i := int64(1); i <= 2*maxBlockEntities+1; i++ {
+		objects = append(objects, &Node{ID: i, Lat: 1, Lon: 2, Tags: map[string]string{}, Info: Info{Visible: true}})
+	}
+	for i := int64(1); i <= 10; i++ {
+		objects = append(objects, &Way{ID: i, NodeIDs: []int64{i, i + 1}, Tags: map[string]string{}, Info: Info{Visible: true}})
+	}
+
+	actual := decodeAll(t, NewDecoder(bytes.NewReader(encodePBF(t, nil, objects))))
+	if len(actual) != len(objects) {
+		t.Fatalf("expected %d objects, got %d", len(objects), len(actual))
+	}
+	for i := range objects {
+		if reflect.TypeOf(objects[i]) != reflect.TypeOf(actual[i]) {
+			t.Fatalf("object %d: expected %T, got %T", i, objects[i], actual[i])
+		}
+	}
+}
+
+func TestEncodeUnsupportedType(t *testing.T) {
+	e := NewEncoder(io.Discard, nil)
+	if err := e.Encode(42); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestEncodeLocationsOnWays(t *testing.T) {
+	w := &Way{
+		ID:        1,
+		Tags:      map[string]string{"highway": "residential"},
+		NodeIDs:   []int64{10, 11, 12},
+		Info:      ew.Info,
+		Locations: []Location{{51.5, -0.1}, {51.5442632, -0.2010027}, {-33.8688197, 151.2092955}},
+	}
+	header := &Header{
+		RequiredFeatures: []string{"OsmSchema-V0.6", "DenseNodes"},
+		OptionalFeatures: []string{"LocationsOnWays"},
+	}
+
+	objects := decodeAll(t, NewDecoder(bytes.NewReader(encodePBF(t, header, []interface{}{w}))))
+	if len(objects) != 1 {
+		t.Fatalf("expected 1 object, got %d", len(objects))
+	}
+	if !reflect.DeepEqual(w, objects[0]) {
+		t.Errorf("\nExpected: %#v\nActual:   %#v", w, objects[0])
+	}
+}
+
+func TestEncodeChangesets(t *testing.T) {
+	objects := []interface{}{ew, &Changeset{ID: 1}, &Changeset{ID: 2}}
+
+	actual := decodeAll(t, NewDecoder(bytes.NewReader(encodePBF(t, nil, objects))))
+	if !reflect.DeepEqual(objects, actual) {
+		t.Errorf("\nExpected: %#v\nActual:   %#v", objects, actual)
+	}
+}
+
+func TestEncodeRequiredFeatures(t *testing.T) {
+	header := &Header{RequiredFeatures: []string{"OsmSchema-V0.6", "HistoricalInformation"}}
+	d := NewDecoder(bytes.NewReader(encodePBF(t, header, []interface{}{en})))
+	actual, err := d.Header()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"OsmSchema-V0.6", "DenseNodes", "HistoricalInformation"}
+	if !reflect.DeepEqual(expected, actual.RequiredFeatures) {
+		t.Errorf("expected required features %q, got %q", expected, actual.RequiredFeatures)
+	}
+}
+
+func TestEncodeBlockRawSize(t *testing.T) {
+	// well compressible nodes exceeding MaxBlobSize together
+	var objects []interface{}
+	for i := 0; i < 20; i++ {
+		value := strings.Repeat(string(rune('a'+i)), 2<<20)
+		objects = append(objects, &Node{ID: int64(i + 1), Tags: map[string]string{"k": value}, Info: Info{Visible: true}})
+	}
+	actual := decodeAll(t, NewDecoder(bytes.NewReader(encodePBF(t, nil, objects))))
+	if len(actual) != len(objects) {
+		t.Fatalf("expected %d objects, got %d", len(objects), len(actual))
+	}
+
+	var buf bytes.Buffer
+	e := NewEncoder(&buf, nil)
+	e.Encode(&Node{ID: 1, Tags: map[string]string{"k": strings.Repeat("a", MaxBlobSize)}})
+	if err := e.Close(); err == nil {
+		t.Error("expected error for node larger than MaxBlobSize")
+	}
+}
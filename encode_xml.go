@@ -0,0 +1,179 @@
+package osmpbf
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+var xmlMemberTypeNames = map[MemberType]string{
+	NodeType:     "node",
+	WayType:      "way",
+	RelationType: "relation",
+}
+
+// An XMLEncoder writes OpenStreetMap XML data (.osm files) in OSM 0.6 schema to an output stream.
+type XMLEncoder struct {
+	w      io.Writer
+	e      *xml.Encoder
+	header *Header
+
+	// first error encountered, returned by all subsequent calls
+	err           error
+	headerWritten bool
+}
+
+// NewXMLEncoder returns a new encoder that writes to w. The root element with
+// generator attribute and <bounds> element are built from header, which may be nil.
+func NewXMLEncoder(w io.Writer, header *Header) *XMLEncoder {
+	if header == nil {
+		header = new(Header)
+	}
+	e := xml.NewEncoder(w)
+	e.Indent("", " ")
+	return &XMLEncoder{w: w, e: e, header: header}
+}
+
+// Encode writes a pointer to Node, Way, Relation or Changeset struct to the output stream.
+// Close must be called to finish the document.
+func (enc *XMLEncoder) Encode(v interface{}) error {
+	if enc.err != nil {
+		return enc.err
+	}
+
+	var x interface{}
+	switch v := v.(type) {
+	case *Node:
+		x = &xmlNode{
+			ID:      v.ID,
+			Lat:     xmlCoordinate(v.Lat),
+			Lon:     xmlCoordinate(v.Lon),
+			xmlInfo: newXMLInfo(v.Info),
+			Tags:    newXMLTags(v.Tags, v.TagList),
+		}
+	case *Way:
+		w := &xmlWay{ID: v.ID, xmlInfo: newXMLInfo(v.Info), Tags: newXMLTags(v.Tags, v.TagList)}
+		w.Nds = make([]xmlNd, len(v.NodeIDs))
+		for index, id := range v.NodeIDs {
+			w.Nds[index].Ref = id
+		}
+		x = w
+	case *Relation:
+		r := &xmlRelation{ID: v.ID, xmlInfo: newXMLInfo(v.Info), Tags: newXMLTags(v.Tags, v.TagList)}
+		r.Members = make([]xmlMember, len(v.Members))
+		for index, m := range v.Members {
+			r.Members[index] = xmlMember{xmlMemberTypeNames[m.Type], m.ID, m.Role}
+		}
+		x = r
+	case *Changeset:
+		x = &xmlChangeset{ID: v.ID}
+	default:
+		return fmt.Errorf("unsupported type %T", v)
+	}
+
+	if err := enc.writeHeader(); err != nil {
+		return err
+	}
+	if err := enc.e.Encode(x); err != nil {
+		enc.err = err
+		return err
+	}
+	return nil
+}
+
+// Close writes the end of the document and flushes output. It does not close
+// the underlying writer.
+func (enc *XMLEncoder) Close() error {
+	if enc.err != nil {
+		return enc.err
+	}
+	if err := enc.writeHeader(); err != nil {
+		return err
+	}
+
+	if err := enc.e.EncodeToken(xml.EndElement{Name: xml.Name{Local: "osm"}}); err != nil {
+		enc.err = err
+		return err
+	}
+	if err := enc.e.Flush(); err != nil {
+		enc.err = err
+		return err
+	}
+	if _, err := io.WriteString(enc.w, "\n"); err != nil {
+		enc.err = err
+		return err
+	}
+
+	enc.err = errEncoderClosed
+	return nil
+}
+
+func (enc *XMLEncoder) writeHeader() error {
+	if enc.headerWritten {
+		return nil
+	}
+	enc.headerWritten = true
+
+	generator := enc.header.WritingProgram
+	if generator == "" {
+		generator = writingProgram
+	}
+	if _, err := io.WriteString(enc.w, xml.Header); err != nil {
+		enc.err = err
+		return err
+	}
+
+	root := xml.StartElement{
+		Name: xml.Name{Local: "osm"},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "version"}, Value: "0.6"},
+			{Name: xml.Name{Local: "generator"}, Value: generator},
+		},
+	}
+	if err := enc.e.EncodeToken(root); err != nil {
+		enc.err = err
+		return err
+	}
+
+	if b := enc.header.BoundingBox; b != nil {
+		bounds := &xmlBounds{
+			MinLat: xmlCoordinate(b.Bottom),
+			MinLon: xmlCoordinate(b.Left),
+			MaxLat: xmlCoordinate(b.Top),
+			MaxLon: xmlCoordinate(b.Right),
+		}
+		if err := enc.e.Encode(bounds); err != nil {
+			enc.err = err
+			return err
+		}
+	}
+	return nil
+}
+
+func newXMLInfo(info Info) xmlInfo {
+	xi := xmlInfo{
+		Version:   info.Version,
+		Changeset: info.Changeset,
+		Uid:       info.Uid,
+		User:      info.User,
+	}
+	if info != (Info{}) {
+		// zero Info is missing rather than deleted object
+		xi.Visible = strconv.FormatBool(info.Visible)
+	}
+	if !info.Timestamp.IsZero() {
+		xi.Timestamp = info.Timestamp.UTC().Format(time.RFC3339)
+	}
+	return xi
+}
+
+func newXMLTags(tags map[string]string, list []Tag) []xmlTag {
+	list = tagList(tags, list)
+	xt := make([]xmlTag, 0, len(list))
+	for _, tag := range list {
+		xt = append(xt, xmlTag{tag.Key, tag.Value})
+	}
+	return xt
+}
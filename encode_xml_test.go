@@ -0,0 +1,73 @@
+package osmpbf
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestXMLEncoderRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewXMLEncoder(&buf, encodeHeader)
+	for _, o := range encodeObjects {
+		if err := enc.Encode(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Encode(en); err == nil {
+		t.Error("expected error after Close")
+	}
+
+	d := NewXMLDecoder(&buf)
+	header, err := d.Header()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.WritingProgram != encodeHeader.WritingProgram || !bboxAlmostEqual(header.BoundingBox, encodeHeader.BoundingBox) {
+		t.Errorf("unexpected header %#v", header)
+	}
+
+	var objects []interface{}
+	for {
+		o, err := d.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		objects = append(objects, o)
+	}
+	if !reflect.DeepEqual(encodeObjects, objects) {
+		t.Errorf("\nExpected: %#v\nActual:   %#v", encodeObjects, objects)
+	}
+}
+
+func TestXMLEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewXMLEncoder(&buf, nil)
+	enc.Encode(&Node{ID: 1, Lat: 0.00001, Lon: -180, Tags: map[string]string{"b": "2", "a": "<1>"}})
+	enc.Encode(&Relation{ID: 2, Members: []Member{{1, NodeType, "stop"}}, Info: Info{Version: 3, Visible: true}})
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `<?xml version="1.0" encoding="UTF-8"?>
+<osm version="0.6" generator="github.com/qedus/osmpbf">
+ <node id="1" lat="0.00001" lon="-180">
+  <tag k="a" v="&lt;1&gt;"></tag>
+  <tag k="b" v="2"></tag>
+ </node>
+ <relation id="2" version="3" visible="true">
+  <member type="node" ref="1" role="stop"></member>
+ </relation>
+</osm>
+`
+	if actual := buf.String(); actual != expected {
+		t.Errorf("\nExpected: %s\nActual:   %s", expected, actual)
+	}
+}
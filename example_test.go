@@ -47,6 +47,8 @@ func Example() {
 			case *osmpbf.Relation:
 				// Process Relation v.
 				rc++
+			case *osmpbf.Changeset:
+				// Process Changeset v.
 			default:
 				log.Fatalf("unknown type %T\n", v)
 			}
@@ -57,3 +59,34 @@ func Example() {
 	// Output:
 	// Nodes: 2729006, Ways: 459055, Relations: 12833
 }
+
+type counter struct {
+	nc, wc, rc, cc uint64
+}
+
+func (c *counter) Node(n *osmpbf.Node)            { c.nc++ }
+func (c *counter) Way(w *osmpbf.Way)              { c.wc++ }
+func (c *counter) Relation(r *osmpbf.Relation)    { c.rc++ }
+func (c *counter) Changeset(cs *osmpbf.Changeset) { c.cc++ }
+
+func ExampleDecoder_Run() {
+	f, err := os.Open("greater-london-140324.osm.pbf")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	d := osmpbf.NewDecoder(f)
+	err = d.Start(runtime.GOMAXPROCS(-1))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// objects are passed to counter in file order
+	var c counter
+	if err = d.Run(&c); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("Nodes: %d, Ways: %d, Relations: %d, Changesets: %d\n", c.nc, c.wc, c.rc, c.cc)
+}
@@ -0,0 +1,202 @@
+package osmpbf
+
+import (
+	"io"
+	"math"
+	"runtime"
+)
+
+// A Region is an area of an extract, see Extract.
+type Region interface {
+	// Contains reports whether location is inside the region.
+	Contains(loc Location) bool
+
+	// Bounds returns bounding box of the region.
+	Bounds() BoundingBox
+}
+
+// Contains reports whether location is inside the bounding box, including its border.
+func (b BoundingBox) Contains(loc Location) bool {
+	return b.Bottom <= loc.Lat && loc.Lat <= b.Top && b.Left <= loc.Lon && loc.Lon <= b.Right
+}
+
+// Bounds returns the bounding box itself.
+func (b BoundingBox) Bounds() BoundingBox {
+	return b
+}
+
+// Polygon is a region bounded by one or more rings. A location is inside the polygon
+// if it is inside an odd number of rings, so inner rings make holes. Rings may be
+// closed or not, the last location is connected to the first one anyway.
+type Polygon [][]Location
+
+// Contains reports whether location is inside the polygon using even-odd rule.
+func (p Polygon) Contains(loc Location) bool {
+	inside := false
+	for _, ring := range p {
+		for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+			a, b := ring[i], ring[j]
+			if (a.Lat > loc.Lat) != (b.Lat > loc.Lat) &&
+				loc.Lon < (b.Lon-a.Lon)*(loc.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lon {
+				inside = !inside
+			}
+		}
+	}
+	return inside
+}
+
+// Bounds returns bounding box of all polygon locations.
+func (p Polygon) Bounds() BoundingBox {
+	b := BoundingBox{Left: math.Inf(1), Right: math.Inf(-1), Top: math.Inf(-1), Bottom: math.Inf(1)}
+	for _, ring := range p {
+		for _, loc := range ring {
+			b.Left = math.Min(b.Left, loc.Lon)
+			b.Right = math.Max(b.Right, loc.Lon)
+			b.Bottom = math.Min(b.Bottom, loc.Lat)
+			b.Top = math.Max(b.Top, loc.Lat)
+		}
+	}
+	return b
+}
+
+type idSet map[int64]struct{}
+
+func (s idSet) has(id int64) bool {
+	_, ok := s[id]
+	return ok
+}
+
+// Extract writes to w objects of PBF file r within region, like "complete_ways" strategy
+// of osmium extract: nodes inside the region, ways with at least one of those nodes
+// together with all their nodes, relations with at least one of those nodes or ways
+// as a member, and parent relations of those relations, recursively. Members of
+// relations are not added otherwise.
+//
+// The file is read twice, so r must be seekable; nodes must precede ways and ways must
+// precede relations, as in sorted files. Header of r is written with bounding box of region.
+func Extract(w io.Writer, r io.ReadSeeker, region Region) error {
+	nodes := make(idSet)
+	ways := make(idSet)
+	relations := make(idSet)
+
+	// first pass: select objects
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	dec := NewDecoder(r)
+	dec.SkipInfo()
+	dec.SkipTags()
+	if err = dec.Start(runtime.GOMAXPROCS(-1)); err != nil {
+		return err
+	}
+	wayNodes := make(idSet)
+	parents := make(map[int64][]int64) // parent relations by ID of member relation
+	err = dec.Run(extractSelector{
+		node: func(n *Node) {
+			if region.Contains(Location{n.Lat, n.Lon}) {
+				nodes[n.ID] = struct{}{}
+			}
+		},
+		way: func(way *Way) {
+			for _, id := range way.NodeIDs {
+				if nodes.has(id) {
+					ways[way.ID] = struct{}{}
+					for _, id := range way.NodeIDs {
+						wayNodes[id] = struct{}{}
+					}
+					return
+				}
+			}
+		},
+		relation: func(rel *Relation) {
+			for _, m := range rel.Members {
+				if m.Type == RelationType {
+					parents[m.ID] = append(parents[m.ID], rel.ID)
+				}
+				if (m.Type == NodeType && nodes.has(m.ID)) || (m.Type == WayType && ways.has(m.ID)) {
+					relations[rel.ID] = struct{}{}
+				}
+			}
+		},
+	})
+	dec.Close()
+	if err != nil {
+		return err
+	}
+	for id := range wayNodes {
+		nodes[id] = struct{}{}
+	}
+	// parents may precede their members, so they are added after all relations are seen
+	queue := make([]int64, 0, len(relations))
+	for id := range relations {
+		queue = append(queue, id)
+	}
+	for len(queue) > 0 {
+		id := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		for _, parent := range parents[id] {
+			if !relations.has(parent) {
+				relations[parent] = struct{}{}
+				queue = append(queue, parent)
+			}
+		}
+	}
+
+	// second pass: write selected objects
+	if _, err = r.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	dec = NewDecoder(r)
+	header, err := dec.Header()
+	if err != nil {
+		return err
+	}
+	h := *header
+	bounds := region.Bounds()
+	h.BoundingBox = &bounds
+	if err = dec.Start(runtime.GOMAXPROCS(-1)); err != nil {
+		return err
+	}
+	defer dec.Close()
+
+	enc := NewEncoder(w, &h)
+	for {
+		o, err := dec.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		var selected bool
+		switch o := o.(type) {
+		case *Node:
+			selected = nodes.has(o.ID)
+		case *Way:
+			selected = ways.has(o.ID)
+		case *Relation:
+			selected = relations.has(o.ID)
+		}
+		if !selected {
+			continue
+		}
+		if err = enc.Encode(o); err != nil {
+			return err
+		}
+	}
+	return enc.Close()
+}
+
+// Handler calling functions for objects used by Extract.
+type extractSelector struct {
+	node     func(*Node)
+	way      func(*Way)
+	relation func(*Relation)
+}
+
+func (s extractSelector) Node(n *Node)         { s.node(n) }
+func (s extractSelector) Way(w *Way)           { s.way(w) }
+func (s extractSelector) Relation(r *Relation) { s.relation(r) }
+func (s extractSelector) Changeset(*Changeset) {}
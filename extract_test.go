@@ -0,0 +1,75 @@
+package osmpbf
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestExtract(t *testing.T) {
+	objects := []interface{}{
+		&Node{ID: 1, Lat: 1, Lon: 1, Tags: map[string]string{}, Info: en.Info},
+		&Node{ID: 2, Lat: 5, Lon: 5, Tags: map[string]string{}, Info: en.Info},
+		&Node{ID: 3, Lat: 3, Lon: 3, Tags: map[string]string{}, Info: en.Info},
+		&Way{ID: 1, Tags: map[string]string{}, NodeIDs: []int64{1, 3}, Info: ew.Info},
+		&Way{ID: 2, Tags: map[string]string{}, NodeIDs: []int64{2, 3}, Info: ew.Info},
+		&Relation{ID: 1, Tags: map[string]string{}, Members: []Member{{1, WayType, "outer"}}, Info: er.Info},
+		&Relation{ID: 2, Tags: map[string]string{}, Members: []Member{{2, NodeType, ""}}, Info: er.Info},
+		&Relation{ID: 3, Tags: map[string]string{}, Members: []Member{{1, RelationType, ""}}, Info: er.Info},
+		// parent relation before its member
+		&Relation{ID: 4, Tags: map[string]string{}, Members: []Member{{5, RelationType, ""}}, Info: er.Info},
+		&Relation{ID: 5, Tags: map[string]string{}, Members: []Member{{3, RelationType, ""}}, Info: er.Info},
+		&Relation{ID: 6, Tags: map[string]string{}, Members: []Member{{2, RelationType, ""}}, Info: er.Info},
+	}
+	expected := []interface{}{objects[0], objects[2], objects[3], objects[5], objects[7], objects[8], objects[9]}
+
+	for _, region := range []Region{
+		BoundingBox{Left: 0, Right: 2, Bottom: 0, Top: 2},
+		Polygon{{{0, 0}, {0, 2}, {2, 2}, {2, 0}}},
+	} {
+		var buf bytes.Buffer
+		if err := Extract(&buf, bytes.NewReader(encodePBF(t, encodeHeader, objects)), region); err != nil {
+			t.Fatal(err)
+		}
+
+		d := NewDecoder(&buf)
+		header, err := d.Header()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bbox := region.Bounds(); !bboxAlmostEqual(header.BoundingBox, &bbox) {
+			t.Errorf("expected bbox %v, got %v", bbox, header.BoundingBox)
+		}
+		if header.Source != encodeHeader.Source {
+			t.Errorf("expected source %q, got %q", encodeHeader.Source, header.Source)
+		}
+		if actual := decodeAll(t, d); !reflect.DeepEqual(expected, actual) {
+			t.Errorf("%v:\nExpected: %#v\nActual:   %#v", region, expected, actual)
+		}
+	}
+}
+
+func TestPolygonContains(t *testing.T) {
+	// square with a square hole
+	p := Polygon{
+		{{0, 0}, {0, 10}, {10, 10}, {10, 0}, {0, 0}},
+		{{4, 4}, {4, 6}, {6, 6}, {6, 4}},
+	}
+	for _, test := range []struct {
+		loc    Location
+		inside bool
+	}{
+		{Location{1, 1}, true},
+		{Location{5, 5}, false},
+		{Location{3, 5}, true},
+		{Location{11, 5}, false},
+		{Location{-1, -1}, false},
+	} {
+		if p.Contains(test.loc) != test.inside {
+			t.Errorf("%v: expected %v", test.loc, test.inside)
+		}
+	}
+	if b := p.Bounds(); b != (BoundingBox{Left: 0, Right: 10, Top: 10, Bottom: 0}) {
+		t.Errorf("unexpected bounds %v", b)
+	}
+}
@@ -1,5 +1,9 @@
 module github.com/qedus/osmpbf
 
-go 1.16
+go 1.22
 
-require google.golang.org/protobuf v1.27.1 // sync version with OSMPBF/Makefile
+require (
+	github.com/klauspost/compress v1.18.0
+	github.com/ulikunitz/xz v0.5.15
+	google.golang.org/protobuf v1.27.1 // sync version with OSMPBF/Makefile
+)
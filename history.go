@@ -0,0 +1,64 @@
+package osmpbf
+
+// History holds consecutive versions of one object, as stored in full-history files
+// with "HistoricalInformation" required feature.
+type History struct {
+	ID int64
+
+	// Versions are pointers to Node, Way, Relation or Changeset structs of the same type in file order.
+	Versions []interface{}
+}
+
+// A HistoryDecoder groups consecutive versions of the same object returned by Decoder.
+type HistoryDecoder struct {
+	dec *Decoder
+
+	// object read ahead and error encountered
+	next interface{}
+	err  error
+}
+
+// NewHistoryDecoder returns a new decoder that reads objects from dec.
+// dec must be started and must not be in ReuseObjects mode.
+func NewHistoryDecoder(dec *Decoder) *HistoryDecoder {
+	hd := &HistoryDecoder{dec: dec}
+	if dec.options.arenas != nil {
+		// versions are kept across blocks, which reuse memory
+		hd.err = errHistoryReuse
+	}
+	return hd
+}
+
+// Decode returns all consecutive versions of the next object, or error encountered.
+// The end of the input stream is reported by an io.EOF error.
+//
+// Decode is not safe for parallel execution.
+func (hd *HistoryDecoder) Decode() (*History, error) {
+	if hd.next == nil {
+		if hd.err != nil {
+			return nil, hd.err
+		}
+		if hd.next, hd.err = hd.dec.Decode(); hd.err != nil {
+			return nil, hd.err
+		}
+	}
+
+	kind, id, _ := objectKindID(hd.next)
+	h := &History{ID: id, Versions: []interface{}{hd.next}}
+	hd.next = nil
+
+	for {
+		v, err := hd.dec.Decode()
+		if err != nil {
+			// return error on next call
+			hd.err = err
+			return h, nil
+		}
+
+		if k, i, _ := objectKindID(v); k != kind || i != id {
+			hd.next = v
+			return h, nil
+		}
+		h.Versions = append(h.Versions, v)
+	}
+}
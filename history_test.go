@@ -0,0 +1,56 @@
+package osmpbf
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestHistoryDecoder(t *testing.T) {
+	header := &Header{
+		RequiredFeatures: []string{"OsmSchema-V0.6", "DenseNodes", "HistoricalInformation"},
+	}
+
+	version := func(info Info, version int32, visible bool) Info {
+		info.Version = version
+		info.Visible = visible
+		return info
+	}
+	objects := []interface{}{
+		&Node{ID: 1, Lat: 1, Lon: 2, Tags: map[string]string{}, Info: version(en.Info, 1, true)},
+		&Node{ID: 1, Lat: 1, Lon: 3, Tags: map[string]string{}, Info: version(en.Info, 2, true)},
+		&Node{ID: 1, Tags: map[string]string{}, Info: version(en.Info, 3, false)},
+		&Node{ID: 2, Lat: 1, Lon: 2, Tags: map[string]string{}, Info: version(en.Info, 1, true)},
+		&Way{ID: 2, Tags: map[string]string{}, NodeIDs: []int64{1, 2}, Info: version(ew.Info, 1, true)},
+		&Way{ID: 2, Tags: map[string]string{}, NodeIDs: []int64{}, Info: version(ew.Info, 2, false)},
+		&Relation{ID: 3, Tags: map[string]string{}, Members: []Member{}, Info: version(er.Info, 1, false)},
+	}
+	expected := []*History{
+		{ID: 1, Versions: objects[0:3]},
+		{ID: 2, Versions: objects[3:4]},
+		{ID: 2, Versions: objects[4:6]},
+		{ID: 3, Versions: objects[6:7]},
+	}
+
+	d := NewDecoder(bytes.NewReader(encodePBF(t, header, objects)))
+	if err := d.Start(2); err != nil {
+		t.Fatal(err)
+	}
+
+	hd := NewHistoryDecoder(d)
+	var actual []*History
+	for {
+		h, err := hd.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual = append(actual, h)
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("\nExpected: %#v\nActual:   %#v", expected, actual)
+	}
+}
@@ -0,0 +1,559 @@
+package osmpbf
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/qedus/osmpbf/OSMPBF"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrNotFound is returned by IndexedReader when requested object is not present in the file.
+var ErrNotFound = errors.New("object not found")
+
+// IDRange describes IDs of objects of one type in a fileblock.
+type IDRange struct {
+	Min   int64
+	Max   int64
+	Count int
+}
+
+// Contains reports whether id is within the range.
+func (r IDRange) Contains(id int64) bool {
+	return r.Count > 0 && r.Min <= id && id <= r.Max
+}
+
+func (r *IDRange) add(id int64) {
+	if r.Count == 0 || id < r.Min {
+		r.Min = id
+	}
+	if r.Count == 0 || id > r.Max {
+		r.Max = id
+	}
+	r.Count++
+}
+
+// BlobInfo describes a fileblock of a PBF file.
+type BlobInfo struct {
+	// Index is the position of the fileblock in the file;
+	// the OSMHeader fileblock has index 0.
+	Index int64
+
+	// Offset is the position of the fileblock in the file in bytes.
+	Offset int64
+
+	// HeaderSize and DataSize are sizes of BlobHeader and Blob in bytes.
+	HeaderSize int32
+	DataSize   int32
+
+	// Type is BlobHeader type, "OSMHeader" or "OSMData".
+	Type string
+
+	// Scanned reports whether Blob was read to set the fields below, see IndexedReader.ScanIDs.
+	Scanned bool
+
+	// Compression is the name of Blob compression as in SupportedCompressions.
+	Compression string
+
+	// IDs of objects in OSMData fileblock.
+	Nodes     IDRange
+	Ways      IDRange
+	Relations IDRange
+}
+
+// An IndexedReader provides random access to fileblocks of a PBF file.
+// It is safe for parallel execution if the underlying io.ReaderAt is.
+type IndexedReader struct {
+	r      io.ReaderAt
+	header *Header
+	// fileblocks can be searched by ID ranges
+	sorted bool
+
+	// guards BlobInfo updated by scanning
+	mu    sync.Mutex
+	blobs []BlobInfo
+}
+
+// NewIndexedReader returns a new reader that reads from r of given size. It reads only the header
+// and BlobHeaders of other fileblocks; ID ranges of fileblocks are found when objects are looked up,
+// by binary search in files with "Sort.Type_then_ID" optional feature, or by ScanIDs otherwise.
+// Capabilities are required features the caller knows are safe to ignore, see Decoder.AddCapabilities.
+func NewIndexedReader(r io.ReaderAt, size int64, capabilities ...string) (*IndexedReader, error) {
+	// reuse Decoder for sequential scan
+	sr := io.NewSectionReader(r, 0, size)
+	dec := NewDecoder(sr)
+	dec.AddCapabilities(capabilities...)
+
+	blobHeader, blob, err := dec.readFileBlock()
+	if err != nil {
+		return nil, err
+	}
+	info := BlobInfo{
+		HeaderSize:  int32(dec.offset) - 4 - blobHeader.GetDatasize(),
+		DataSize:    blobHeader.GetDatasize(),
+		Type:        blobHeader.GetType(),
+		Scanned:     true,
+		Compression: blobCompression(blob),
+	}
+	if info.Type != "OSMHeader" {
+		return nil, &DecodeError{0, 0, info.Type, StageBlobHeader,
+			fmt.Errorf("%w %s", ErrUnexpectedBlobType, info.Type)}
+	}
+	if err = dec.decodeOSMHeader(blob); err != nil {
+		return nil, err
+	}
+	ir := &IndexedReader{
+		r:      r,
+		header: dec.header,
+		sorted: dec.header.KnownFeatures().SortTypeThenID,
+		blobs:  []BlobInfo{info},
+	}
+
+	for {
+		index, offset := dec.index, dec.offset
+		blobHeader, err := dec.skipFileBlock(sr)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		info := BlobInfo{
+			Index:      index,
+			Offset:     offset,
+			HeaderSize: int32(dec.offset-offset) - 4 - blobHeader.GetDatasize(),
+			DataSize:   blobHeader.GetDatasize(),
+			Type:       blobHeader.GetType(),
+		}
+		if info.Type != "OSMData" {
+			return nil, &DecodeError{index, offset, info.Type, StageBlobHeader,
+				fmt.Errorf("%w %s", ErrUnexpectedBlobType, info.Type)}
+		}
+		ir.blobs = append(ir.blobs, info)
+	}
+
+	return ir, nil
+}
+
+// Read BlobHeader of the next fileblock and seek over its Blob.
+func (dec *Decoder) skipFileBlock(sr *io.SectionReader) (*OSMPBF.BlobHeader, error) {
+	dec.buf.Reset()
+	blobHeaderSize, err := dec.readBlobHeaderSize()
+	if err == io.EOF {
+		return nil, err
+	}
+	if err != nil {
+		return nil, dec.decodeError(StageBlobHeaderSize, "", err)
+	}
+
+	blobHeader, err := dec.readBlobHeader(blobHeaderSize)
+	if err != nil {
+		return nil, dec.decodeError(StageBlobHeader, "", err)
+	}
+
+	end := dec.offset + 4 + int64(blobHeaderSize) + int64(blobHeader.GetDatasize())
+	if end > sr.Size() {
+		return nil, dec.decodeError(StageBlob, blobHeader.GetType(), io.ErrUnexpectedEOF)
+	}
+	if _, err = sr.Seek(end, io.SeekStart); err != nil {
+		return nil, dec.decodeError(StageBlob, blobHeader.GetType(), err)
+	}
+
+	dec.index++
+	dec.offset = end
+	return blobHeader, nil
+}
+
+// Header returns file header.
+func (ir *IndexedReader) Header() *Header {
+	return ir.header
+}
+
+// Blobs returns descriptions of all fileblocks in file order. Fields set by scanning
+// are present only for fileblocks scanned so far.
+func (ir *IndexedReader) Blobs() []BlobInfo {
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+	return append([]BlobInfo(nil), ir.blobs...)
+}
+
+// ScanIDs reads fileblocks not scanned yet using n goroutines, decoding only IDs
+// of objects to set ID ranges of BlobInfo. It returns the first error in file order.
+func (ir *IndexedReader) ScanIDs(n int) error {
+	if n < 1 {
+		n = 1
+	}
+
+	errs := make([]error, len(ir.blobs))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				_, errs[index] = ir.scan(index)
+			}
+		}()
+	}
+	for index := range ir.blobs {
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return description of fileblock, reading its Blob if it was not scanned yet.
+func (ir *IndexedReader) scan(index int) (BlobInfo, error) {
+	ir.mu.Lock()
+	info := ir.blobs[index]
+	ir.mu.Unlock()
+	if info.Scanned {
+		return info, nil
+	}
+
+	blob, err := ir.readBlob(&info)
+	if err != nil {
+		return info, err
+	}
+	info.Compression = blobCompression(blob)
+	if err = info.scanIDs(blob); err != nil {
+		return info, positionError(err, info.Index, info.Offset)
+	}
+	info.Scanned = true
+
+	ir.mu.Lock()
+	ir.blobs[index] = info
+	ir.mu.Unlock()
+	return info, nil
+}
+
+// Read Blob of fileblock.
+func (ir *IndexedReader) readBlob(info *BlobInfo) (*OSMPBF.Blob, error) {
+	data := make([]byte, info.DataSize)
+	n, err := ir.r.ReadAt(data, info.Offset+4+int64(info.HeaderSize))
+	if err == io.EOF && n == len(data) {
+		// ReadAt may return io.EOF with the last fileblock
+		err = nil
+	}
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, &DecodeError{info.Index, info.Offset, info.Type, StageBlob, err}
+	}
+	blob := new(OSMPBF.Blob)
+	if err = proto.Unmarshal(data, blob); err != nil {
+		return nil, &DecodeError{info.Index, info.Offset, info.Type, StageBlob, err}
+	}
+	return blob, nil
+}
+
+// Collect ID ranges of objects in blob.
+func (info *BlobInfo) scanIDs(blob *OSMPBF.Blob) error {
+	data, err := getData(blob)
+	if err != nil {
+		return &DecodeError{Type: info.Type, Stage: StageDecompress, Err: err}
+	}
+	if err = info.scanPrimitiveBlock(data); err != nil {
+		return &DecodeError{Type: info.Type, Stage: StagePrimitiveBlock, Err: err}
+	}
+	return nil
+}
+
+// Collect IDs from PrimitiveBlock data without unpacking other fields.
+func (info *BlobInfo) scanPrimitiveBlock(data []byte) error {
+	for len(data) > 0 {
+		f, rest, err := nextField(data)
+		if err != nil {
+			return err
+		}
+		data = rest
+		if f.num == 2 && f.typ == protowire.BytesType {
+			if err = info.scanPrimitiveGroup(f.bytes); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (info *BlobInfo) scanPrimitiveGroup(data []byte) error {
+	var deltas []int64
+	for len(data) > 0 {
+		f, rest, err := nextField(data)
+		if err != nil {
+			return err
+		}
+		data = rest
+		if f.typ != protowire.BytesType {
+			continue
+		}
+
+		var id int64
+		switch f.num {
+		case 1:
+			id, err = scanID(f.bytes, zigzag64, "OSMPBF.Node.id")
+			info.Nodes.add(id)
+		case 2:
+			deltas, err = scanDenseIDs(f.bytes, deltas[:0])
+			for _, delta := range deltas {
+				id = delta + id // delta encoding
+				info.Nodes.add(id)
+			}
+		case 3:
+			id, err = scanID(f.bytes, varint64, "OSMPBF.Way.id")
+			info.Ways.add(id)
+		case 4:
+			id, err = scanID(f.bytes, varint64, "OSMPBF.Relation.id")
+			info.Relations.add(id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return required id field of Node, Way or Relation message.
+func scanID(data []byte, convert func(uint64) int64, name string) (int64, error) {
+	var id int64
+	found := false
+	for len(data) > 0 {
+		f, rest, err := nextField(data)
+		if err != nil {
+			return 0, err
+		}
+		data = rest
+		if f.num == 1 && f.typ == protowire.VarintType {
+			id, found = convert(f.varint), true
+		}
+	}
+	if !found {
+		return 0, requiredField(name)
+	}
+	return id, nil
+}
+
+// Append delta coded IDs of DenseNodes message.
+func scanDenseIDs(data []byte, deltas []int64) ([]int64, error) {
+	for len(data) > 0 {
+		f, rest, err := nextField(data)
+		if err != nil {
+			return deltas, err
+		}
+		data = rest
+		if f.num == 1 {
+			if deltas, err = appendVarints(deltas, f, zigzag64); err != nil {
+				return deltas, err
+			}
+		}
+	}
+	return deltas, nil
+}
+
+// DecodeBlob decodes OSMData fileblock with given index.
+func (ir *IndexedReader) DecodeBlob(index int) (*Block, error) {
+	if index < 0 || index >= len(ir.blobs) {
+		return nil, fmt.Errorf("fileblock index %d out of range", index)
+	}
+	ir.mu.Lock()
+	info := ir.blobs[index]
+	ir.mu.Unlock()
+	if info.Type != "OSMData" {
+		return nil, &DecodeError{info.Index, info.Offset, info.Type, StageBlobHeader,
+			fmt.Errorf("%w %s", ErrUnexpectedBlobType, info.Type)}
+	}
+
+	blob, err := ir.readBlob(&info)
+	if err != nil {
+		return nil, err
+	}
+	objects, err := new(dataDecoder).Decode(blob)
+	if err != nil {
+		return nil, positionError(err, info.Index, info.Offset)
+	}
+	return newBlock(info.Index, info.Offset, objects), nil
+}
+
+// Node returns node with given ID, or ErrNotFound.
+func (ir *IndexedReader) Node(id int64) (*Node, error) {
+	o, err := ir.find(NodeType, id)
+	if err != nil {
+		return nil, err
+	}
+	return o.(*Node), nil
+}
+
+// Way returns way with given ID, or ErrNotFound.
+func (ir *IndexedReader) Way(id int64) (*Way, error) {
+	o, err := ir.find(WayType, id)
+	if err != nil {
+		return nil, err
+	}
+	return o.(*Way), nil
+}
+
+// Relation returns relation with given ID, or ErrNotFound.
+func (ir *IndexedReader) Relation(id int64) (*Relation, error) {
+	o, err := ir.find(RelationType, id)
+	if err != nil {
+		return nil, err
+	}
+	return o.(*Relation), nil
+}
+
+// Return range of IDs of objects with given type.
+func (info *BlobInfo) idRange(t MemberType) IDRange {
+	switch t {
+	case NodeType:
+		return info.Nodes
+	case WayType:
+		return info.Ways
+	default:
+		return info.Relations
+	}
+}
+
+// Decode only fileblocks which may contain object with given type and ID.
+func (ir *IndexedReader) find(t MemberType, id int64) (interface{}, error) {
+	indexes, err := ir.candidates(t, id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, index := range indexes {
+		b, err := ir.DecodeBlob(index)
+		if err != nil {
+			return nil, err
+		}
+		switch t {
+		case NodeType:
+			for _, n := range b.Nodes {
+				if n.ID == id {
+					return n, nil
+				}
+			}
+		case WayType:
+			for _, w := range b.Ways {
+				if w.ID == id {
+					return w, nil
+				}
+			}
+		case RelationType:
+			for _, r := range b.Relations {
+				if r.ID == id {
+					return r, nil
+				}
+			}
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Return indexes of fileblocks whose ID ranges contain given ID.
+func (ir *IndexedReader) candidates(t MemberType, id int64) ([]int, error) {
+	if ir.sorted && id >= 0 {
+		indexes, ok, err := ir.search(t, id)
+		if ok || err != nil {
+			return indexes, err
+		}
+	}
+
+	if err := ir.ScanIDs(runtime.GOMAXPROCS(0)); err != nil {
+		return nil, err
+	}
+	var indexes []int
+	for index, info := range ir.Blobs() {
+		if r := info.idRange(t); r.Contains(id) {
+			indexes = append(indexes, index)
+		}
+	}
+	return indexes, nil
+}
+
+// Position of object in Sort.Type_then_ID order, for objects with non-negative IDs.
+type objectKey struct {
+	t  MemberType
+	id int64
+}
+
+func (k objectKey) less(other objectKey) bool {
+	return k.t < other.t || (k.t == other.t && k.id < other.id)
+}
+
+// Return the first and the last object of scanned fileblock. Fileblocks without objects or with
+// negative IDs, which are sorted by absolute value, are not ordered by IDRange and are not ok.
+func (info *BlobInfo) keyRange() (first, last objectKey, ok bool) {
+	for _, t := range []MemberType{NodeType, WayType, RelationType} {
+		r := info.idRange(t)
+		if r.Count == 0 {
+			continue
+		}
+		if r.Min < 0 {
+			return first, last, false
+		}
+		if !ok {
+			first, ok = objectKey{t, r.Min}, true
+		}
+		last = objectKey{t, r.Max}
+	}
+	return first, last, ok
+}
+
+// Find fileblocks of a sorted file by binary search, scanning only fileblocks on its way.
+// Returns false if the file is not ordered as expected.
+func (ir *IndexedReader) search(t MemberType, id int64) ([]int, bool, error) {
+	key := objectKey{t, id}
+
+	// first OSMData fileblock not entirely before key
+	lo, hi := 1, len(ir.blobs)
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		info, err := ir.scan(mid)
+		if err != nil {
+			return nil, false, err
+		}
+		_, last, ok := info.keyRange()
+		if !ok {
+			return nil, false, nil
+		}
+		if last.less(key) {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+
+	// objects with the same ID may continue in the next fileblocks of history files
+	var indexes []int
+	for index := lo; index < len(ir.blobs); index++ {
+		info, err := ir.scan(index)
+		if err != nil {
+			return nil, false, err
+		}
+		first, _, ok := info.keyRange()
+		if !ok {
+			return nil, false, nil
+		}
+		if key.less(first) {
+			break
+		}
+		if r := info.idRange(t); r.Contains(id) {
+			indexes = append(indexes, index)
+		}
+	}
+	return indexes, true, nil
+}
@@ -0,0 +1,168 @@
+package osmpbf
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestIndexedReader(t *testing.T) {
+	objects := append(manyNodes(maxBlockEntities+1), encodeObjects...)
+	data := encodePBF(t, encodeHeader, objects)
+
+	ir, err := NewIndexedReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ir.Header().WritingProgram != encodeHeader.WritingProgram {
+		t.Errorf("expected writing program %q, got %q", encodeHeader.WritingProgram, ir.Header().WritingProgram)
+	}
+
+	expected := []BlobInfo{
+		{Index: 0, Type: "OSMHeader", Scanned: true},
+		{Index: 1, Type: "OSMData"},
+		{Index: 2, Type: "OSMData"},
+		{Index: 3, Type: "OSMData"},
+		{Index: 4, Type: "OSMData"},
+	}
+	checkBlobs(t, ir.Blobs(), expected, int64(len(data)))
+
+	// binary search scans only fileblocks on its way
+	w, err := ir.Way(ew.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ew, w) {
+		t.Errorf("\nExpected: %#v\nActual:   %#v", ew, w)
+	}
+	if ir.Blobs()[1].Scanned {
+		t.Error("expected fileblock 1 not to be scanned")
+	}
+
+	if err = ir.ScanIDs(2); err != nil {
+		t.Fatal(err)
+	}
+	expected = []BlobInfo{
+		{Index: 0, Type: "OSMHeader", Scanned: true},
+		{Index: 1, Type: "OSMData", Scanned: true, Nodes: IDRange{1, maxBlockEntities, maxBlockEntities}},
+		{Index: 2, Type: "OSMData", Scanned: true, Nodes: IDRange{maxBlockEntities + 1, en.ID + 1, 3}},
+		{Index: 3, Type: "OSMData", Scanned: true, Ways: IDRange{ew.ID, ew.ID, 1}},
+		{Index: 4, Type: "OSMData", Scanned: true, Relations: IDRange{er.ID, er.ID, 1}},
+	}
+	checkBlobs(t, ir.Blobs(), expected, int64(len(data)))
+
+	n, err := ir.Node(en.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(en, n) {
+		t.Errorf("\nExpected: %#v\nActual:   %#v", en, n)
+	}
+	r, err := ir.Relation(er.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(er, r) {
+		t.Errorf("\nExpected: %#v\nActual:   %#v", er, r)
+	}
+
+	if _, err = ir.Way(ew.ID + 1); err != ErrNotFound {
+		t.Errorf("expected %v, got %v", ErrNotFound, err)
+	}
+	if _, err = ir.DecodeBlob(0); err == nil {
+		t.Error("expected error for OSMHeader fileblock")
+	}
+}
+
+// Check fileblock descriptions other than positions, sizes and compression of scanned fileblocks.
+func checkBlobs(t *testing.T, blobs, expected []BlobInfo, size int64) {
+	t.Helper()
+	if len(blobs) != len(expected) {
+		t.Fatalf("expected %d fileblocks, got %d", len(expected), len(blobs))
+	}
+	var offset int64
+	for i, b := range blobs {
+		if b.Offset != offset {
+			t.Errorf("fileblock %d: expected offset %d, got %d", i, offset, b.Offset)
+		}
+		offset += 4 + int64(b.HeaderSize) + int64(b.DataSize)
+		if b.Scanned && b.Compression != "zlib" {
+			t.Errorf("fileblock %d: expected zlib compression, got %q", i, b.Compression)
+		}
+
+		b.Offset, b.HeaderSize, b.DataSize, b.Compression = 0, 0, 0, ""
+		if !reflect.DeepEqual(expected[i], b) {
+			t.Errorf("\nExpected: %#v\nActual:   %#v", expected[i], b)
+		}
+	}
+	if offset != size {
+		t.Errorf("expected total size %d, got %d", size, offset)
+	}
+}
+
+func TestIndexedReaderUnsorted(t *testing.T) {
+	header := *encodeHeader
+	header.OptionalFeatures = nil
+	header.RequiredFeatures = append([]string{"Custom"}, encodeHeader.RequiredFeatures...)
+	data := encodePBF(t, &header, encodeObjects)
+
+	_, err := NewIndexedReader(bytes.NewReader(data), int64(len(data)))
+	if !errors.Is(err, ErrUnsupportedFeature) {
+		t.Fatalf("expected %v, got %v", ErrUnsupportedFeature, err)
+	}
+
+	ir, err := NewIndexedReader(bytes.NewReader(data), int64(len(data)), "Custom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := ir.Relation(er.ID) // scans all fileblocks
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(er, r) {
+		t.Errorf("\nExpected: %#v\nActual:   %#v", er, r)
+	}
+	for _, b := range ir.Blobs() {
+		if !b.Scanned {
+			t.Errorf("fileblock %d: expected to be scanned", b.Index)
+		}
+	}
+}
+
+// ReaderAt returning io.EOF with data read up to the end, as io.ReaderAt allows.
+type eofReaderAt struct {
+	*bytes.Reader
+}
+
+func (r eofReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.Reader.ReadAt(p, off)
+	if err == nil && off+int64(n) == r.Size() {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func TestIndexedReaderEOF(t *testing.T) {
+	data := encodePBF(t, encodeHeader, encodeObjects)
+	ir, err := NewIndexedReader(eofReaderAt{bytes.NewReader(data)}, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := ir.Relation(er.ID) // in the last fileblock
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(er, r) {
+		t.Errorf("\nExpected: %#v\nActual:   %#v", er, r)
+	}
+
+	ir, err = NewIndexedReader(eofReaderAt{bytes.NewReader(data[:len(data)-1])}, int64(len(data)))
+	if err == nil {
+		_, err = ir.Relation(er.ID)
+	}
+	if err == nil {
+		t.Error("expected error for truncated file")
+	}
+}
@@ -0,0 +1,44 @@
+package locations
+
+import "github.com/qedus/osmpbf"
+
+// Dense is an in-memory array of locations indexed by node ID, similar to osmium
+// flex_mem in dense mode. It takes 8 bytes for every ID up to the maximum one.
+type Dense struct {
+	locs []packed
+}
+
+// NewDense returns an empty Dense store.
+func NewDense() *Dense {
+	return new(Dense)
+}
+
+// Set stores location of node with given ID.
+func (d *Dense) Set(id int64, loc osmpbf.Location) error {
+	if id < 0 {
+		return ErrNegativeID
+	}
+	p, err := pack(loc)
+	if err != nil {
+		return err
+	}
+	if id >= int64(len(d.locs)) {
+		n := 2 * int64(len(d.locs))
+		if n <= id {
+			n = id + 1
+		}
+		locs := make([]packed, n)
+		copy(locs, d.locs)
+		d.locs = locs
+	}
+	d.locs[id] = p
+	return nil
+}
+
+// Get returns location of node with given ID and whether it was found.
+func (d *Dense) Get(id int64) (osmpbf.Location, bool) {
+	if id < 0 || id >= int64(len(d.locs)) || !d.locs[id].valid() {
+		return osmpbf.Location{}, false
+	}
+	return d.locs[id].location(), true
+}
@@ -0,0 +1,60 @@
+// Package locations provides stores of node locations for osmpbf.Decoder.SetLocationStore.
+//
+// Locations are kept as 32-bit fixed point numbers with 100 nanodegree precision,
+// the default granularity of PBF files, so each location takes 8 bytes.
+// Stores are not safe for concurrent use.
+//
+// Sparse fits extracts, where node IDs are scattered; Dense and Mmap fit large files,
+// where memory is allocated for every ID up to the maximum one. Mmap keeps data in a
+// file, so it may be larger than physical memory.
+package locations
+
+import (
+	"errors"
+	"math"
+
+	"github.com/qedus/osmpbf"
+)
+
+var (
+	// ErrNegativeID is returned by dense stores for nodes with negative IDs.
+	ErrNegativeID = errors.New("negative node ID")
+
+	// ErrInvalidLocation is returned for coordinates outside of valid range.
+	ErrInvalidLocation = errors.New("invalid location")
+)
+
+// Coordinates are stored as units of 100 nanodegrees shifted by bias,
+// so zero value means unset location.
+const (
+	latBias = 90*1e7 + 1
+	lonBias = 180*1e7 + 1
+)
+
+type packed struct {
+	lat uint32
+	lon uint32
+}
+
+func pack(loc osmpbf.Location) (packed, error) {
+	// negated comparisons are also true for NaN
+	if !(loc.Lat >= -90 && loc.Lat <= 90 && loc.Lon >= -180 && loc.Lon <= 180) {
+		return packed{}, ErrInvalidLocation
+	}
+	return packed{
+		lat: uint32(int64(math.Round(loc.Lat*1e7)) + latBias),
+		lon: uint32(int64(math.Round(loc.Lon*1e7)) + lonBias),
+	}, nil
+}
+
+// Same computation as in osmpbf decoder, so that equal coordinates are returned.
+func (p packed) location() osmpbf.Location {
+	return osmpbf.Location{
+		Lat: 1e-9 * float64(100*(int64(p.lat)-latBias)),
+		Lon: 1e-9 * float64(100*(int64(p.lon)-lonBias)),
+	}
+}
+
+func (p packed) valid() bool {
+	return p.lat != 0
+}
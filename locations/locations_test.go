@@ -0,0 +1,93 @@
+package locations
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/qedus/osmpbf"
+)
+
+func testStore(t *testing.T, s osmpbf.LocationStore, negative bool) {
+	locs := map[int64]osmpbf.Location{
+		0:       {Lat: 0, Lon: 0},
+		1:       {Lat: 51.5073219, Lon: -0.1276474},
+		7:       {Lat: -90, Lon: 180},
+		3:       {Lat: 90, Lon: -180},
+		1 << 21: {Lat: -33.8567844, Lon: 151.213108},
+	}
+	if negative {
+		locs[-5] = osmpbf.Location{Lat: 1, Lon: 2}
+	}
+	for _, id := range []int64{0, 1, 7, 3, 1 << 21, -5} {
+		if loc, ok := locs[id]; ok {
+			if err := s.Set(id, loc); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for id, expected := range locs {
+		loc, ok := s.Get(id)
+		if !ok {
+			t.Errorf("%d: not found", id)
+		}
+		if math.Abs(loc.Lat-expected.Lat) > 1e-7 || math.Abs(loc.Lon-expected.Lon) > 1e-7 {
+			t.Errorf("%d: expected %v, got %v", id, expected, loc)
+		}
+	}
+	for _, id := range []int64{2, 8, 1<<21 + 1, 1 << 40} {
+		if _, ok := s.Get(id); ok {
+			t.Errorf("%d: unexpectedly found", id)
+		}
+	}
+
+	if err := s.Set(10, osmpbf.Location{Lat: 91}); err != ErrInvalidLocation {
+		t.Errorf("expected %v, got %v", ErrInvalidLocation, err)
+	}
+	if err := s.Set(10, osmpbf.Location{Lat: math.NaN()}); err != ErrInvalidLocation {
+		t.Errorf("expected %v, got %v", ErrInvalidLocation, err)
+	}
+	if err := s.Set(-1, osmpbf.Location{}); !negative && err != ErrNegativeID {
+		t.Errorf("expected %v, got %v", ErrNegativeID, err)
+	}
+}
+
+func TestSparse(t *testing.T) {
+	s := NewSparse()
+	testStore(t, s, true)
+
+	// last location wins
+	if err := s.Set(1, osmpbf.Location{Lat: 1, Lon: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if loc, _ := s.Get(1); loc != (osmpbf.Location{Lat: 1, Lon: 1}) {
+		t.Errorf("expected updated location, got %v", loc)
+	}
+}
+
+func TestDense(t *testing.T) {
+	testStore(t, NewDense(), false)
+}
+
+func TestMmap(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "locations")
+	m, err := NewMmap(name)
+	if err != nil {
+		t.Skip(err)
+	}
+	testStore(t, m, false)
+	if err = m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopen existing file
+	m, err = NewMmap(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if loc, ok := m.Get(1 << 21); !ok || loc != (osmpbf.Location{Lat: -33.8567844, Lon: 151.213108}) {
+		t.Errorf("unexpected location %v %v", loc, ok)
+	}
+}
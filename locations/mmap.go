@@ -0,0 +1,115 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package locations
+
+import (
+	"encoding/binary"
+	"os"
+	"syscall"
+
+	"github.com/qedus/osmpbf"
+)
+
+// minimal file growth in entries (8MB)
+const mmapChunk = 1 << 20
+
+// Mmap is an array of locations indexed by node ID in a memory mapped file, similar to
+// osmium dense_mmap_array. It takes 8 bytes of the file for every ID up to the maximum one;
+// on most file systems unused parts of the file do not take disk space.
+type Mmap struct {
+	f    *os.File
+	data []byte
+}
+
+// NewMmap returns a store backed by file with given name. The file is created if it does not
+// exist; locations already stored in it are kept, so a store may be reused between runs.
+func NewMmap(name string) (*Mmap, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	m := &Mmap{f: f}
+
+	fi, err := f.Stat()
+	if err == nil && fi.Size() >= 8 {
+		err = m.remap(fi.Size() / 8)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// Map file to memory with size of n entries.
+func (m *Mmap) remap(n int64) error {
+	if m.data != nil {
+		if err := syscall.Munmap(m.data); err != nil {
+			return err
+		}
+		m.data = nil
+	}
+	if err := m.f.Truncate(8 * n); err != nil {
+		return err
+	}
+	data, err := syscall.Mmap(int(m.f.Fd()), 0, int(8*n), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	m.data = data
+	return nil
+}
+
+// Set stores location of node with given ID.
+func (m *Mmap) Set(id int64, loc osmpbf.Location) error {
+	if id < 0 {
+		return ErrNegativeID
+	}
+	p, err := pack(loc)
+	if err != nil {
+		return err
+	}
+	if size := int64(len(m.data) / 8); id >= size {
+		n := 2 * size
+		if n < mmapChunk {
+			n = mmapChunk
+		}
+		if n <= id {
+			n = id + 1
+		}
+		if err = m.remap(n); err != nil {
+			return err
+		}
+	}
+	binary.LittleEndian.PutUint32(m.data[8*id:], p.lat)
+	binary.LittleEndian.PutUint32(m.data[8*id+4:], p.lon)
+	return nil
+}
+
+// Get returns location of node with given ID and whether it was found.
+func (m *Mmap) Get(id int64) (osmpbf.Location, bool) {
+	if id < 0 || id >= int64(len(m.data)/8) {
+		return osmpbf.Location{}, false
+	}
+	p := packed{
+		lat: binary.LittleEndian.Uint32(m.data[8*id:]),
+		lon: binary.LittleEndian.Uint32(m.data[8*id+4:]),
+	}
+	if !p.valid() {
+		return osmpbf.Location{}, false
+	}
+	return p.location(), true
+}
+
+// Close unmaps and closes the file. The file is not removed.
+func (m *Mmap) Close() error {
+	var err error
+	if m.data != nil {
+		err = syscall.Munmap(m.data)
+		m.data = nil
+	}
+	if cerr := m.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
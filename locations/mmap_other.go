@@ -0,0 +1,33 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package locations
+
+import (
+	"errors"
+
+	"github.com/qedus/osmpbf"
+)
+
+// Mmap is an array of locations indexed by node ID in a memory mapped file.
+// It is not supported on this platform.
+type Mmap struct{}
+
+// NewMmap returns an error, memory mapped files are not supported on this platform.
+func NewMmap(name string) (*Mmap, error) {
+	return nil, errors.New("locations: mmap is not supported on this platform")
+}
+
+// Set stores location of node with given ID.
+func (m *Mmap) Set(id int64, loc osmpbf.Location) error {
+	return errors.New("locations: mmap is not supported on this platform")
+}
+
+// Get returns location of node with given ID and whether it was found.
+func (m *Mmap) Get(id int64) (osmpbf.Location, bool) {
+	return osmpbf.Location{}, false
+}
+
+// Close does nothing.
+func (m *Mmap) Close() error {
+	return nil
+}